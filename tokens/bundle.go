@@ -0,0 +1,364 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TrustBundle is a set of trust anchors, typically stored in a JSON file and loaded into a TrustStore
+type TrustBundle struct {
+	// Anchors are the keys trusted to issue tokens
+	Anchors []TrustAnchor `json:"anchors"`
+}
+
+// TrustAnchor is a key trusted to issue tokens like an org issuer or a RSA signer
+type TrustAnchor struct {
+	// Name is a unique name for the anchor
+	Name string `json:"name"`
+
+	// PublicKey is a hex encoded ed25519 public key or a PEM encoded RSA, ECDSA or ed25519 public key or certificate
+	PublicKey string `json:"public_key"`
+
+	// OrganizationUnits restricts the anchor to issuing tokens for these organization units, when any anchor in a
+	// bundle sets organization units the bundle is used as a Federation and anchors without organization units
+	// are trusted for the choria organization unit only
+	OrganizationUnits []string `json:"ous,omitempty"`
+
+	// NotBefore is the time the anchor becomes trusted
+	NotBefore *time.Time `json:"not_before,omitempty"`
+
+	// NotAfter is the time the anchor stops being trusted
+	NotAfter *time.Time `json:"not_after,omitempty"`
+
+	// Metadata is free form information about the anchor
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	key crypto.PublicKey
+}
+
+// Key is the parsed public key of the anchor
+func (a *TrustAnchor) Key() crypto.PublicKey {
+	return a.key
+}
+
+// IsActive determines if the anchor is trusted at time t
+func (a *TrustAnchor) IsActive(t time.Time) bool {
+	if a.NotBefore != nil && t.Before(*a.NotBefore) {
+		return false
+	}
+
+	if a.NotAfter != nil && !t.Before(*a.NotAfter) {
+		return false
+	}
+
+	return true
+}
+
+// ParseTrustBundle parses and validates a JSON encoded trust bundle
+func ParseTrustBundle(dat []byte) (*TrustBundle, error) {
+	bundle := &TrustBundle{}
+	err := json.Unmarshal(dat, bundle)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trust bundle: %w", err)
+	}
+
+	if len(bundle.Anchors) == 0 {
+		return nil, fmt.Errorf("invalid trust bundle: no trust anchors")
+	}
+
+	names := make(map[string]struct{})
+	for i := range bundle.Anchors {
+		anchor := &bundle.Anchors[i]
+
+		if anchor.Name == "" {
+			return nil, fmt.Errorf("invalid trust bundle: anchor %d has no name", i)
+		}
+		if _, ok := names[anchor.Name]; ok {
+			return nil, fmt.Errorf("invalid trust bundle: duplicate anchor %s", anchor.Name)
+		}
+		names[anchor.Name] = struct{}{}
+
+		if anchor.NotBefore != nil && anchor.NotAfter != nil && !anchor.NotAfter.After(*anchor.NotBefore) {
+			return nil, fmt.Errorf("invalid trust bundle: anchor %s is never valid", anchor.Name)
+		}
+
+		anchor.key, err = readPublicKeyData([]byte(strings.TrimSpace(anchor.PublicKey)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust bundle: anchor %s: %w", anchor.Name, err)
+		}
+	}
+
+	return bundle, nil
+}
+
+// ParseTrustBundleFile parses and validates a JSON encoded trust bundle stored in file
+func ParseTrustBundleFile(file string) (*TrustBundle, error) {
+	dat, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseTrustBundle(dat)
+}
+
+// IsFederated determines if any anchor is restricted to organization units
+func (b *TrustBundle) IsFederated() bool {
+	for _, anchor := range b.Anchors {
+		if len(anchor.OrganizationUnits) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TrustStore holds a trust bundle loaded from a file, it can be passed to ParseToken and related functions in place
+// of a single public key and is safe for concurrent use.
+//
+// The bundle is reloaded when the file changes using Reload or Watch, anchors are only used while they are active
+type TrustStore struct {
+	file       string
+	clock      func() time.Time
+	content    []byte
+	bundle     *TrustBundle
+	trust      any
+	nextChange time.Time
+	version    uint64
+	mu         sync.Mutex
+}
+
+// TrustStoreOption configures a TrustStore
+type TrustStoreOption func(*TrustStore) error
+
+// WithTrustStoreClock sets the function used to determine the current time when selecting active anchors, defaults to time.Now
+func WithTrustStoreClock(clock func() time.Time) TrustStoreOption {
+	return func(s *TrustStore) error {
+		if clock == nil {
+			return fmt.Errorf("clock is required")
+		}
+
+		s.clock = clock
+		return nil
+	}
+}
+
+// NewTrustStore creates a TrustStore and loads the trust bundle in file
+func NewTrustStore(file string, opts ...TrustStoreOption) (*TrustStore, error) {
+	if file == "" {
+		return nil, fmt.Errorf("trust bundle file is required")
+	}
+
+	s := &TrustStore{
+		file:  file,
+		clock: time.Now,
+	}
+
+	for _, opt := range opts {
+		err := opt(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err := s.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reload loads the trust bundle file when its content changed, on failure the previously loaded bundle is kept
+func (s *TrustStore) Reload() (bool, error) {
+	dat, err := os.ReadFile(s.file)
+	if err != nil {
+		return false, fmt.Errorf("could not read trust bundle: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bundle != nil && bytes.Equal(dat, s.content) {
+		return false, nil
+	}
+
+	bundle, err := ParseTrustBundle(dat)
+	if err != nil {
+		return false, err
+	}
+
+	s.content = dat
+	s.bundle = bundle
+	s.trust = nil
+
+	return true, nil
+}
+
+// Watch checks the trust bundle file for changes every interval until ctx is canceled, failed reloads are logged
+// and the previously loaded bundle is kept. An error is returned without watching when interval or log is invalid
+func (s *TrustStore) Watch(ctx context.Context, interval time.Duration, log *logrus.Entry) error {
+	if interval <= 0 {
+		return fmt.Errorf("watch interval must be positive")
+	}
+
+	if log == nil {
+		return fmt.Errorf("logger is required")
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			changed, err := s.Reload()
+			switch {
+			case err != nil:
+				log.Errorf("Could not reload trust bundle %s: %v", s.file, err)
+			case changed:
+				log.Infof("Reloaded trust bundle %s", s.file)
+			}
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Bundle is the currently loaded trust bundle
+func (s *TrustStore) Bundle() *TrustBundle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.bundle
+}
+
+// ActiveAnchors are the anchors in the loaded trust bundle that are currently trusted
+func (s *TrustStore) ActiveAnchors() []TrustAnchor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock()
+
+	var active []TrustAnchor
+	for _, anchor := range s.bundle.Anchors {
+		if anchor.IsActive(now) {
+			active = append(active, anchor)
+		}
+	}
+
+	return active
+}
+
+// resolve is the *Keyring or *Federation holding the active anchors, rebuilt when the bundle changed or an anchor
+// became active or inactive since it was last built
+func (s *TrustStore) resolve() (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock()
+	if s.trust != nil && (s.nextChange.IsZero() || now.Before(s.nextChange)) {
+		return s.trust, nil
+	}
+
+	var keyring *Keyring
+	var federation *Federation
+	federated := s.bundle.IsFederated()
+	if federated {
+		federation = NewFederation()
+	} else {
+		keyring = &Keyring{}
+	}
+
+	var next time.Time
+	setNext := func(t *time.Time) {
+		if t != nil && t.After(now) && (next.IsZero() || t.Before(next)) {
+			next = *t
+		}
+	}
+
+	for _, anchor := range s.bundle.Anchors {
+		setNext(anchor.NotBefore)
+		setNext(anchor.NotAfter)
+
+		if !anchor.IsActive(now) {
+			continue
+		}
+
+		if !federated {
+			err := keyring.Add(anchor.key)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		ous := anchor.OrganizationUnits
+		if len(ous) == 0 {
+			ous = []string{defaultOrg}
+		}
+
+		for _, ou := range ous {
+			err := federation.AddTrustedKeys(ou, anchor.key)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if federated {
+		s.trust = federation
+	} else {
+		s.trust = keyring
+	}
+	s.nextChange = next
+	s.version = nextTrustVersion()
+
+	return s.trust, nil
+}
+
+// trustVersion changes whenever the trust bundle is reloaded or anchors become active or inactive
+func (s *TrustStore) trustVersion() (uint64, error) {
+	_, err := s.resolve()
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.version, nil
+}
+
+// parseTokenWithTrustStore verifies token using the anchors currently active in the trust store
+func parseTokenWithTrustStore(d *decodedToken, s *TrustStore, opts *parseOpts) error {
+	trust, err := s.resolve()
+	if err != nil {
+		return err
+	}
+
+	switch trust := trust.(type) {
+	case *Federation:
+		return parseTokenWithFederation(d, trust, opts)
+	case *Keyring:
+		if trust.Len() == 0 {
+			return fmt.Errorf("no active trust anchors")
+		}
+		return parseTokenWithKeyring(d, trust, opts)
+	default:
+		return fmt.Errorf("unsupported trust type %T", trust)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	iu "github.com/choria-io/go-choria/internal/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("TrustBundle", func() {
+	var (
+		file      string
+		rsaToken  string
+		edToken   string
+		acmeToken string
+		edAnchor  TrustAnchor
+		rsaAnchor TrustAnchor
+		now       time.Time
+	)
+
+	writeBundle := func(anchors ...TrustAnchor) {
+		dat, err := json.Marshal(TrustBundle{Anchors: anchors})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.WriteFile(file, dat, 0600)).To(Succeed())
+	}
+
+	clock := func() time.Time { return now }
+
+	BeforeEach(func() {
+		file = filepath.Join(GinkgoT().TempDir(), "trust.json")
+		now = time.Now()
+
+		rsaPEM, err := os.ReadFile("testdata/rsa/signer-public.pem")
+		Expect(err).ToNot(HaveOccurred())
+		edPubK, err := os.ReadFile("testdata/ed25519/signer.public")
+		Expect(err).ToNot(HaveOccurred())
+
+		rsaAnchor = TrustAnchor{Name: "rsa", PublicKey: string(rsaPEM), Metadata: map[string]string{"owner": "ops"}}
+		edAnchor = TrustAnchor{Name: "org", PublicKey: string(edPubK)}
+
+		_, edPriK := loadEd25519Seed("testdata/ed25519/signer.seed")
+		rsaToken = newTestClientToken("", mustSigner(loadRSAPriKey("testdata/rsa/signer-key.pem")))
+		edToken = newTestClientToken("", mustSigner(edPriK))
+		acmeToken = newTestClientToken("acme", mustSigner(edPriK))
+	})
+
+	Describe("ParseTrustBundle", func() {
+		It("Should validate the bundle", func() {
+			_, err := ParseTrustBundle([]byte("{}"))
+			Expect(err).To(MatchError("invalid trust bundle: no trust anchors"))
+
+			_, err = ParseTrustBundle([]byte(`{"anchors":[{"public_key":"x"}]}`))
+			Expect(err).To(MatchError("invalid trust bundle: anchor 0 has no name"))
+
+			_, err = ParseTrustBundle([]byte(`{"anchors":[{"name":"x","public_key":"x"}]}`))
+			Expect(err).To(MatchError("invalid trust bundle: anchor x: could not parse ed25519 public data: encoding/hex: invalid byte: U+0078 'x'"))
+
+			writeBundle(edAnchor, edAnchor)
+			_, err = ParseTrustBundleFile(file)
+			Expect(err).To(MatchError("invalid trust bundle: duplicate anchor org"))
+
+			edAnchor.NotBefore = &now
+			edAnchor.NotAfter = &now
+			writeBundle(edAnchor)
+			_, err = ParseTrustBundleFile(file)
+			Expect(err).To(MatchError("invalid trust bundle: anchor org is never valid"))
+		})
+
+		It("Should parse keys", func() {
+			writeBundle(edAnchor, rsaAnchor)
+			bundle, err := ParseTrustBundleFile(file)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bundle.Anchors).To(HaveLen(2))
+			Expect(bundle.Anchors[0].Key()).To(BeAssignableToTypeOf(ed25519.PublicKey{}))
+			Expect(bundle.Anchors[1].Key()).To(Equal(loadRSAPubKey("testdata/rsa/signer-public.pem")))
+			Expect(bundle.Anchors[1].Metadata).To(Equal(map[string]string{"owner": "ops"}))
+			Expect(bundle.IsFederated()).To(BeFalse())
+		})
+	})
+
+	Describe("TrustStore", func() {
+		It("Should require a valid bundle", func() {
+			_, err := NewTrustStore("")
+			Expect(err).To(MatchError("trust bundle file is required"))
+
+			_, err = NewTrustStore(file)
+			Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+		})
+
+		It("Should verify tokens using all anchors", func() {
+			writeBundle(edAnchor, rsaAnchor)
+			store, err := NewTrustStore(file)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseClientIDToken(rsaToken, store, true)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = ParseClientIDToken(edToken, store, true)
+			Expect(err).ToNot(HaveOccurred())
+
+			v, err := NewVerifier(WithTrustStore(store))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = v.VerifyClient(rsaToken)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = NewVerifier(WithTrustStore(store), WithTrustedKeys(loadRSAPubKey("testdata/rsa/signer-public.pem")))
+			Expect(err).To(MatchError("trusted keys can not be combined with a trust store"))
+		})
+
+		It("Should reload changed bundles", func() {
+			writeBundle(edAnchor)
+			store, err := NewTrustStore(file)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseClientIDToken(rsaToken, store, true)
+			Expect(err).To(MatchError("could not parse client id token: no suitable RS256 key found in keyring"))
+
+			changed, err := store.Reload()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changed).To(BeFalse())
+
+			writeBundle(edAnchor, rsaAnchor)
+			changed, err = store.Reload()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changed).To(BeTrue())
+			Expect(store.Bundle().Anchors).To(HaveLen(2))
+
+			_, err = ParseClientIDToken(rsaToken, store, true)
+			Expect(err).ToNot(HaveOccurred())
+
+			// invalid bundles keep the previous bundle
+			Expect(os.WriteFile(file, []byte("{}"), 0600)).To(Succeed())
+			changed, err = store.Reload()
+			Expect(err).To(MatchError("invalid trust bundle: no trust anchors"))
+			Expect(changed).To(BeFalse())
+			_, err = ParseClientIDToken(rsaToken, store, true)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should only use active anchors", func() {
+			notBefore := now.Add(time.Hour)
+			notAfter := now.Add(2 * time.Hour)
+			rsaAnchor.NotBefore = &notBefore
+			rsaAnchor.NotAfter = &notAfter
+			writeBundle(edAnchor, rsaAnchor)
+
+			store, err := NewTrustStore(file, WithTrustStoreClock(clock))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(store.ActiveAnchors()).To(HaveLen(1))
+
+			_, err = ParseClientIDToken(rsaToken, store, true)
+			Expect(err).To(HaveOccurred())
+
+			now = notBefore
+			Expect(store.ActiveAnchors()).To(HaveLen(2))
+			_, err = ParseClientIDToken(rsaToken, store, true)
+			Expect(err).ToNot(HaveOccurred())
+
+			now = notAfter
+			_, err = ParseClientIDToken(rsaToken, store, true)
+			Expect(err).To(HaveOccurred())
+
+			edAnchor.NotAfter = &notAfter
+			writeBundle(edAnchor)
+			_, err = store.Reload()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = ParseClientIDToken(edToken, store, true)
+			Expect(err).To(MatchError("could not parse client id token: no active trust anchors"))
+		})
+
+		It("Should support federated bundles", func() {
+			acmePubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+
+			writeBundle(edAnchor, TrustAnchor{Name: "acme", PublicKey: hex.EncodeToString(acmePubK), OrganizationUnits: []string{"acme"}})
+			store, err := NewTrustStore(file)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(store.Bundle().IsFederated()).To(BeTrue())
+
+			_, err = ParseClientIDToken(edToken, store, true)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseClientIDToken(acmeToken, store, true)
+			Expect(errors.Is(err, ErrIssuerMismatch)).To(BeTrue())
+		})
+
+		It("Should watch for changes", func() {
+			writeBundle(edAnchor)
+			store, err := NewTrustStore(file)
+			Expect(err).ToNot(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			log := logrus.New()
+			log.SetOutput(GinkgoWriter)
+			Expect(store.Watch(ctx, 0, logrus.NewEntry(log))).To(MatchError("watch interval must be positive"))
+			Expect(store.Watch(ctx, time.Second, nil)).To(MatchError("logger is required"))
+
+			go store.Watch(ctx, 10*time.Millisecond, logrus.NewEntry(log))
+
+			writeBundle(edAnchor, rsaAnchor)
+			Eventually(func() error {
+				_, err := ParseClientIDToken(rsaToken, store, true)
+				return err
+			}).ShouldNot(HaveOccurred())
+		})
+	})
+})
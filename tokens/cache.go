@@ -0,0 +1,223 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// VerificationCache remembers tokens that were verified successfully so that their signatures and trust chains
+// are not verified again until the tokens expire, the least recently used tokens are evicted once the cache is full.
+//
+// Entries are only used when verifying into the same type of claims using the same trust and the same signing
+// methods, maximum chain depth and issuer endorsements that verified them, changes to a Keyring, Federation or the
+// anchors of a TrustStore invalidate entries verified using them. Entries verified while issuer endorsements were valid expire when the first of those
+// endorsements does. Claims are validated and revocation lists checked on every verification, tokens found to be
+// revoked are removed from the cache.
+//
+// A cache is safe for concurrent use
+type VerificationCache struct {
+	size    int
+	entries map[[sha256.Size]byte]*list.Element
+	lru     *list.List
+	mu      sync.Mutex
+}
+
+type verificationCacheEntry struct {
+	hash    [sha256.Size]byte
+	trust   any
+	version uint64
+	params  [sha256.Size]byte
+	expires time.Time
+}
+
+// trustVersions is used to version keyrings, federations and trust stores, it only ever increases so no version is used twice
+var trustVersions uint64
+
+func nextTrustVersion() uint64 {
+	return atomic.AddUint64(&trustVersions, 1)
+}
+
+// NewVerificationCache creates a VerificationCache holding up to size tokens
+func NewVerificationCache(size int) (*VerificationCache, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("cache size must be at least 1")
+	}
+
+	return &VerificationCache{
+		size:    size,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		lru:     list.New(),
+	}, nil
+}
+
+// WithVerificationCache skips verifying the signature and trust chain of tokens that were previously verified successfully using the same trust
+func WithVerificationCache(cache *VerificationCache) ParseOption {
+	return func(o *parseOpts) {
+		o.cache = cache
+	}
+}
+
+// Len is the number of tokens in the cache
+func (c *VerificationCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// Purge removes all tokens from the cache
+func (c *VerificationCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[[sha256.Size]byte]*list.Element)
+	c.lru.Init()
+}
+
+// lookup determines if the token with hash was verified using version of trust and options matching params, and has not expired
+func (c *VerificationCache) lookup(hash [sha256.Size]byte, trust any, version uint64, params [sha256.Size]byte, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[hash]
+	if !ok {
+		return false
+	}
+
+	entry := elem.Value.(*verificationCacheEntry)
+	if entry.trust != trust || entry.version != version || entry.params != params || !now.Before(entry.expires) {
+		c.removeElement(elem)
+		return false
+	}
+
+	c.lru.MoveToFront(elem)
+
+	return true
+}
+
+// add records that the token with hash was verified using version of trust and options matching params, tokens that do not expire are not cached
+func (c *VerificationCache) add(hash [sha256.Size]byte, trust any, version uint64, params [sha256.Size]byte, expires time.Time) {
+	if expires.IsZero() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &verificationCacheEntry{hash: hash, trust: trust, version: version, params: params, expires: expires}
+
+	if elem, ok := c.entries[hash]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[hash] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.size {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// remove removes the token with hash from the cache
+func (c *VerificationCache) remove(hash [sha256.Size]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[hash]; ok {
+		c.removeElement(elem)
+	}
+}
+
+func (c *VerificationCache) removeElement(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*verificationCacheEntry).hash)
+}
+
+func tokenHash(token string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(token))
+}
+
+// cacheParams identifies the claims type and options that influence verifying signatures and trust chains, the
+// claims type determines which chain grants tokens are checked against
+func (o *parseOpts) cacheParams(claims any) [sha256.Size]byte {
+	h := sha256.New()
+
+	fmt.Fprintf(h, "%T\n", claims)
+
+	methods := "*"
+	if o.methods != nil {
+		methods = strings.Join(o.methods, ",")
+	}
+	fmt.Fprintf(h, "%d\n%s\n", o.maxDepth, methods)
+
+	for _, e := range o.endorsements {
+		if e != nil {
+			fmt.Fprintf(h, "%s.%s\n", e.signedData(), e.Signature)
+		}
+	}
+
+	var params [sha256.Size]byte
+	h.Sum(params[:0])
+
+	return params
+}
+
+// cacheExpiry limits expires to the end of the issuer endorsements that could have been used to verify a token at now
+func (o *parseOpts) cacheExpiry(expires time.Time, now time.Time) time.Time {
+	if expires.IsZero() {
+		return expires
+	}
+
+	for _, e := range o.endorsements {
+		if e == nil || now.Before(e.NotBefore) || !now.Before(e.NotAfter) {
+			continue
+		}
+
+		if e.NotAfter.Before(expires) {
+			expires = e.NotAfter
+		}
+	}
+
+	return expires
+}
+
+// trustIdentity identifies the trust pk represents and the current version of its content, verifications
+// using pk can not be cached when ok is false
+func trustIdentity(pk any) (trust any, version uint64, ok bool) {
+	switch pk := pk.(type) {
+	case *Keyring:
+		return pk, pk.trustVersion(), true
+
+	case *Federation:
+		return pk, pk.trustVersion(), true
+
+	case *TrustStore:
+		version, err := pk.trustVersion()
+		if err != nil {
+			return nil, 0, false
+		}
+		return pk, version, true
+
+	case ed25519.PublicKey:
+		return string(pk), 0, true
+
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return pk, 0, true
+
+	default:
+		return nil, 0, false
+	}
+}
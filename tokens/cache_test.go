@@ -0,0 +1,333 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	iu "github.com/choria-io/go-choria/internal/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("VerificationCache", func() {
+	var (
+		cache   *VerificationCache
+		orgPubK ed25519.PublicKey
+		orgPriK ed25519.PrivateKey
+		token   string
+		server  *ServerClaims
+		err     error
+	)
+
+	// forge creates a token not signed by the org issuer and marks it verified by trust in the cache
+	forge := func(trust any) string {
+		_, otherPriK, err := iu.Ed25519KeyPair()
+		Expect(err).ToNot(HaveOccurred())
+		t, err := SignToken(server, mustSigner(otherPriK))
+		Expect(err).ToNot(HaveOccurred())
+
+		id, version, ok := trustIdentity(trust)
+		Expect(ok).To(BeTrue())
+		cache.add(tokenHash(t), id, version, newParseOpts(nil).cacheParams(&ServerClaims{}), server.ExpireTime())
+
+		return t
+	}
+
+	BeforeEach(func() {
+		cache, err = NewVerificationCache(10)
+		Expect(err).ToNot(HaveOccurred())
+
+		orgPubK, orgPriK, err = iu.Ed25519KeyPair()
+		Expect(err).ToNot(HaveOccurred())
+
+		server, err = NewServerClaims("n1.example.net", []string{"choria"}, "", nil, nil, orgPubK, "", time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		token, err = SignToken(server, mustSigner(orgPriK))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Describe("NewVerificationCache", func() {
+		It("Should require a size", func() {
+			_, err := NewVerificationCache(0)
+			Expect(err).To(MatchError("cache size must be at least 1"))
+		})
+	})
+
+	Describe("WithVerificationCache", func() {
+		It("Should cache successful verifications", func() {
+			_, err := ParseServerToken(token, orgPubK, WithVerificationCache(cache))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cache.Len()).To(Equal(1))
+
+			claims, err := ParseServerToken(token, orgPubK, WithVerificationCache(cache))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(claims.ChoriaIdentity).To(Equal("n1.example.net"))
+			Expect(cache.Len()).To(Equal(1))
+
+			otherPubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = ParseServerToken(token, otherPubK, WithVerificationCache(cache))
+			Expect(err).To(MatchError("could not parse server id token: ed25519: verification error"))
+		})
+
+		It("Should skip verification of cached tokens", func() {
+			forged := forge(orgPubK)
+
+			_, err := ParseServerToken(forged, orgPubK)
+			Expect(err).To(HaveOccurred())
+
+			_, err = ParseServerToken(forged, orgPubK, WithVerificationCache(cache))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should not cache failed verifications", func() {
+			otherPubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = ParseServerToken(token, otherPubK, WithVerificationCache(cache))
+			Expect(err).To(HaveOccurred())
+			Expect(cache.Len()).To(Equal(0))
+		})
+
+		It("Should validate claims of cached tokens", func() {
+			server.ExpiresAt.Time = time.Now().Add(-time.Minute)
+			forged := forge(orgPubK)
+			cache.add(tokenHash(forged), string(orgPubK), 0, newParseOpts(nil).cacheParams(&ServerClaims{}), time.Now().Add(time.Hour))
+
+			_, err := ParseServerToken(forged, orgPubK, WithVerificationCache(cache))
+			Expect(err).To(MatchError(ContainSubstring("token is expired")))
+		})
+
+		It("Should only use tokens verified using the same options", func() {
+			forged := forge(orgPubK)
+
+			_, err := ParseServerToken(forged, orgPubK, WithVerificationCache(cache), WithMaxChainDepth(2))
+			Expect(err).To(HaveOccurred())
+			Expect(cache.Len()).To(Equal(0))
+
+			forged = forge(orgPubK)
+			v, err := NewVerifier(WithTrustedKeys(orgPubK), WithParseOptions(WithVerificationCache(cache)), WithAllowedAlgorithms(algEdDSA))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = v.VerifyServer(forged)
+			Expect(err).To(HaveOccurred())
+
+			forged = forge(orgPubK)
+			_, err = ParseServerToken(forged, orgPubK, WithVerificationCache(cache))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should expire tokens when the endorsements used to verify them expire", func() {
+			newPubK, newPriK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			endorsements, err := CrossSignIssuers(mustSigner(orgPriK), mustSigner(newPriK), time.Now().Add(-time.Minute), time.Now().Add(10*time.Minute))
+			Expect(err).ToNot(HaveOccurred())
+
+			handlerPubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			handler, err := NewClientIDClaims("choria=login", nil, "", nil, "", "", time.Hour, nil, handlerPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(handler.AddOrgIssuerData(mustSigner(orgPriK))).To(Succeed())
+			t, err := SignToken(handler, mustSigner(orgPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseClientIDToken(t, newPubK, true, WithVerificationCache(cache), WithIssuerEndorsements(endorsements...))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cache.Len()).To(Equal(1))
+
+			entry := cache.entries[tokenHash(t)].Value.(*verificationCacheEntry)
+			Expect(entry.expires.Unix()).To(Equal(endorsements[0].NotAfter.Unix()))
+
+			params := newParseOpts([]ParseOption{WithIssuerEndorsements(endorsements...)}).cacheParams(&ClientIDClaims{})
+			Expect(cache.lookup(tokenHash(t), string(newPubK), 0, params, endorsements[0].NotAfter)).To(BeFalse())
+		})
+
+		It("Should check chain grants of tokens parsed into other claims", func() {
+			handlerPubK, handlerPriK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			handler, err := NewClientIDClaims("choria=handler", nil, "", nil, "", "", time.Hour, nil, handlerPubK)
+			Expect(err).ToNot(HaveOccurred())
+			handler.ChainGrant = &ChainGrant{Identities: []string{"*"}, OrganizationUnits: []string{"*"}}
+			Expect(handler.AddOrgIssuerData(mustSigner(orgPriK))).To(Succeed())
+
+			server, err := NewServerClaims("n1.example.net", []string{"choria"}, "", nil, nil, orgPubK, "", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+			t, err := SignToken(server, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseClientIDToken(t, orgPubK, false, WithVerificationCache(cache))
+			Expect(errors.Is(err, ErrExceedsGrant)).To(BeTrue())
+
+			_, err = ParseServerToken(t, orgPubK, WithVerificationCache(cache))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cache.Len()).To(Equal(1))
+
+			_, err = ParseClientIDToken(t, orgPubK, false, WithVerificationCache(cache))
+			Expect(err).To(MatchError(ContainSubstring("caller id  is not granted by chain issuer " + handler.ID)))
+			Expect(errors.Is(err, ErrExceedsGrant)).To(BeTrue())
+		})
+
+		It("Should invalidate revoked tokens", func() {
+			_, err := ParseServerToken(token, orgPubK, WithVerificationCache(cache))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cache.Len()).To(Equal(1))
+
+			list, err := NewRevocationListClaims("", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(list.RevokeToken(server.ID)).To(Succeed())
+
+			_, err = ParseServerToken(token, orgPubK, WithVerificationCache(cache), WithRevocations(list))
+			Expect(errors.Is(err, ErrRevoked)).To(BeTrue())
+			Expect(cache.Len()).To(Equal(0))
+		})
+
+		It("Should invalidate tokens when keyrings change", func() {
+			kr, err := NewKeyring(orgPubK)
+			Expect(err).ToNot(HaveOccurred())
+
+			forged := forge(kr)
+			_, err = ParseServerToken(forged, kr, WithVerificationCache(cache))
+			Expect(err).ToNot(HaveOccurred())
+
+			otherPubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(kr.Add(otherPubK)).To(Succeed())
+
+			_, err = ParseServerToken(forged, kr, WithVerificationCache(cache))
+			Expect(err).To(HaveOccurred())
+			Expect(cache.Len()).To(Equal(0))
+		})
+
+		It("Should invalidate tokens when federations change", func() {
+			fed := NewFederation()
+			Expect(fed.AddTrustedKeys("choria", orgPubK)).To(Succeed())
+
+			forged := forge(fed)
+			_, err = ParseServerToken(forged, fed, WithVerificationCache(cache))
+			Expect(err).ToNot(HaveOccurred())
+
+			fed.RemoveOrganizationUnit("acme")
+			_, err = ParseServerToken(forged, fed, WithVerificationCache(cache))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should invalidate tokens when the trust bundle changes", func() {
+			file := filepath.Join(GinkgoT().TempDir(), "trust.json")
+			writeBundle := func(anchors ...TrustAnchor) {
+				dat, err := json.Marshal(TrustBundle{Anchors: anchors})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(os.WriteFile(file, dat, 0600)).To(Succeed())
+			}
+
+			writeBundle(TrustAnchor{Name: "org", PublicKey: hex.EncodeToString(orgPubK)})
+			store, err := NewTrustStore(file)
+			Expect(err).ToNot(HaveOccurred())
+
+			forged := forge(store)
+			_, err = ParseServerToken(forged, store, WithVerificationCache(cache))
+			Expect(err).ToNot(HaveOccurred())
+
+			writeBundle(TrustAnchor{Name: "org", PublicKey: hex.EncodeToString(orgPubK), Metadata: map[string]string{"rotated": "yes"}})
+			changed, err := store.Reload()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changed).To(BeTrue())
+
+			_, err = ParseServerToken(forged, store, WithVerificationCache(cache))
+			Expect(err).To(HaveOccurred())
+
+			_, err = ParseServerToken(token, store, WithVerificationCache(cache))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should be safe for concurrent use", func() {
+			wg := sync.WaitGroup{}
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer GinkgoRecover()
+
+					for j := 0; j < 10; j++ {
+						_, err := ParseServerToken(token, orgPubK, WithVerificationCache(cache))
+						Expect(err).ToNot(HaveOccurred())
+					}
+				}()
+			}
+			wg.Wait()
+
+			Expect(cache.Len()).To(Equal(1))
+		})
+	})
+
+	Describe("Verifier", func() {
+		It("Should use the cache and purge it when revocations change", func() {
+			v, err := NewVerifier(WithTrustedKeys(orgPubK), WithParseOptions(WithVerificationCache(cache)))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = v.VerifyServer(token)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cache.Len()).To(Equal(1))
+
+			list, err := NewRevocationListClaims("", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			v.SetRevocationList(list)
+			Expect(cache.Len()).To(Equal(0))
+		})
+	})
+
+	Describe("lookup", func() {
+		params := newParseOpts(nil).cacheParams(&ServerClaims{})
+
+		It("Should expire tokens", func() {
+			hash := tokenHash(token)
+			now := time.Now()
+			cache.add(hash, "x", 1, params, now.Add(time.Minute))
+
+			Expect(cache.lookup(hash, "x", 1, params, now)).To(BeTrue())
+			Expect(cache.lookup(hash, "x", 2, params, now)).To(BeFalse())
+			Expect(cache.Len()).To(Equal(0))
+
+			cache.add(hash, "x", 1, params, now.Add(time.Minute))
+			Expect(cache.lookup(hash, "y", 1, params, now)).To(BeFalse())
+
+			cache.add(hash, "x", 1, params, now.Add(time.Minute))
+			Expect(cache.lookup(hash, "x", 1, newParseOpts([]ParseOption{WithMaxChainDepth(1)}).cacheParams(&ServerClaims{}), now)).To(BeFalse())
+
+			cache.add(hash, "x", 1, params, now.Add(time.Minute))
+			Expect(cache.lookup(hash, "x", 1, params, now.Add(time.Minute))).To(BeFalse())
+			Expect(cache.Len()).To(Equal(0))
+
+			cache.add(hash, "x", 1, params, time.Time{})
+			Expect(cache.Len()).To(Equal(0))
+		})
+
+		It("Should evict the least recently used tokens", func() {
+			cache, err = NewVerificationCache(2)
+			Expect(err).ToNot(HaveOccurred())
+
+			now := time.Now()
+			a, b, c := tokenHash("a"), tokenHash("b"), tokenHash("c")
+			cache.add(a, "x", 1, params, now.Add(time.Hour))
+			cache.add(b, "x", 1, params, now.Add(time.Hour))
+			Expect(cache.lookup(a, "x", 1, params, now)).To(BeTrue())
+
+			cache.add(c, "x", 1, params, now.Add(time.Hour))
+			Expect(cache.Len()).To(Equal(2))
+			Expect(cache.lookup(b, "x", 1, params, now)).To(BeFalse())
+			Expect(cache.lookup(a, "x", 1, params, now)).To(BeTrue())
+			Expect(cache.lookup(c, "x", 1, params, now)).To(BeTrue())
+
+			cache.Purge()
+			Expect(cache.Len()).To(Equal(0))
+		})
+	})
+})
@@ -0,0 +1,258 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	iu "github.com/choria-io/go-choria/internal/util"
+)
+
+// DefaultMaxChainDepth is the default maximum number of chain issuers allowed between the org issuer and a token
+const DefaultMaxChainDepth = 4
+
+// ChainIssuer is an issuer in a trust chain
+type ChainIssuer struct {
+	// ID is the token ID of the issuer
+	ID string `json:"id"`
+
+	// PublicKey is the hex encoded ed25519 public key of the issuer
+	PublicKey string `json:"public_key"`
+
+	// Grant is the ChainGrant of the issuer
+	Grant *ChainGrant `json:"grant,omitempty"`
+}
+
+// WithMaxChainDepth sets the maximum number of chain issuers allowed between the org issuer and a token, defaults to
+// DefaultMaxChainDepth. Depths below 1 are treated as 1, use WithUnlimitedChainDepth to allow chains of any depth
+func WithMaxChainDepth(depth int) ParseOption {
+	return func(o *parseOpts) {
+		if depth < 1 {
+			depth = 1
+		}
+
+		o.maxDepth = depth
+	}
+}
+
+// WithUnlimitedChainDepth allows any number of chain issuers between the org issuer and a token
+func WithUnlimitedChainDepth() ParseOption {
+	return func(o *parseOpts) {
+		o.maxDepth = 0
+	}
+}
+
+// ChainIssuers are all the chain issuers between the org issuer and this token, starting with the one issued by the org issuer and ending with the issuer of this token
+func (c *StandardClaims) ChainIssuers() ([]ChainIssuer, error) {
+	if !strings.HasPrefix(c.Issuer, ChainIssuerPrefix) {
+		return nil, errMalformedChainData("not issued by a chain issuer")
+	}
+
+	parts := strings.Split(strings.TrimPrefix(c.Issuer, ChainIssuerPrefix), ".")
+	if len(parts) != 2 {
+		return nil, errMalformedChainData("invalid issuer content")
+	}
+
+	issuers := make([]ChainIssuer, 0, len(c.IssuerChain)+1)
+	issuers = append(issuers, c.IssuerChain...)
+	issuers = append(issuers, ChainIssuer{ID: parts[0], PublicKey: parts[1], Grant: c.IssuerGrant})
+
+	return issuers, nil
+}
+
+// ChainDelegateData is the data that should be signed by a chain issuer to allow this token to issue tokens on its behalf.
+//
+// The Issuer should already be set using SetChainIssuer()
+//
+// See AddChainDelegateData for a one-shot way to set the needed data when you have access to the private key.
+func (c *StandardClaims) ChainDelegateData(chainSig string) ([]byte, error) {
+	if c.PublicKey == "" {
+		return nil, fmt.Errorf("public key not set")
+	}
+
+	_, err := c.ChainIssuerData(chainSig)
+	if err != nil {
+		return nil, err
+	}
+
+	grant, err := chainGrantData(c.ChainGrant)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(fmt.Sprintf("%s.%s.%s%s", c.ID, c.PublicKey, chainSig, grant)), nil
+}
+
+// chainGrantData is the data added to the signed chain data of chain issuers that have a grant
+func chainGrantData(grant *ChainGrant) (string, error) {
+	if grant == nil {
+		return "", nil
+	}
+
+	hash, err := grant.hash()
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(".grant:%s", hash), nil
+}
+
+// AddChainDelegateData adds the data that allows a token to issue tokens on behalf of a chain issuer, creating an
+// additional level in the trust chain. The signer must be that of the chain issuer.
+func (c *StandardClaims) AddChainDelegateData(chainIssuer *ClientIDClaims, signer Signer) error {
+	pubK, err := signerEd25519PublicKey(signer)
+	if err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(pubK) != chainIssuer.PublicKey {
+		return fmt.Errorf("signer does not match the chain issuer public key")
+	}
+
+	err = c.SetChainIssuer(chainIssuer)
+	if err != nil {
+		return err
+	}
+
+	c.ChainDelegate = true
+
+	dat, err := c.ChainDelegateData(chainIssuer.TrustChainSignature)
+	if err != nil {
+		return err
+	}
+
+	sig, err := signer.Sign(dat)
+	if err != nil {
+		return err
+	}
+
+	c.SetChainUserTrustSignature(chainIssuer, sig)
+
+	return nil
+}
+
+// verifyChain verifies every link in the trust chain of a token issued by a chain issuer and returns the public key
+// of the issuer of the token. When orgPK is nil the link to the org issuer is not verified.
+//
+// The trust chain signature holds one signature per chain issuer followed by the signature of the token:
+//
+//	org issuer sig(id.pubk) . issuer sig(id.pubk.<previous>) ... . issuer sig(id.<previous>)
+//
+// where the last signature covers id.pubk.<previous> when the token is a chain delegate, chain issuers with
+// a grant have .grant:<grant hash> appended to their signed data
+func (c *StandardClaims) verifyChain(orgPK ed25519.PublicKey, opts *parseOpts) (ed25519.PublicKey, error) {
+	// validates the issuer and signature formats
+	_, _, _, _, err := c.ParseChainIssuerData()
+	if err != nil {
+		return nil, err
+	}
+
+	issuers, err := c.ChainIssuers()
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.maxDepth > 0 && len(issuers) > opts.maxDepth {
+		return nil, newVerificationError(ErrChainTooDeep, nil, "chain depth %d exceeds the maximum of %d", len(issuers), opts.maxDepth)
+	}
+
+	segments := strings.Split(c.TrustChainSignature, ".")
+	if len(segments) != len(issuers)+1 {
+		return nil, errMalformedChainData("invalid trust chain signature")
+	}
+
+	sigs := make([][]byte, len(segments))
+	for i, s := range segments {
+		sigs[i], err = hex.DecodeString(s)
+		if err != nil {
+			return nil, newVerificationError(ErrMalformedChainData, err, "invalid signature in chain signature: %s", err)
+		}
+	}
+
+	keys := make([]ed25519.PublicKey, len(issuers))
+	for i, ci := range issuers {
+		if ci.ID == "" {
+			return nil, errMalformedChainData("invalid id in issuer chain")
+		}
+
+		keys[i], err = hex.DecodeString(ci.PublicKey)
+		if err != nil || len(keys[i]) != ed25519.PublicKeySize {
+			return nil, errMalformedChainData("invalid public key in issuer chain")
+		}
+	}
+
+	grants := make([]string, len(issuers))
+	for i, ci := range issuers {
+		grants[i], err = chainGrantData(ci.Grant)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if orgPK != nil {
+		// during org issuer rotation the chain may be rooted in an org issuer endorsed by orgPK
+		rooted := false
+		for _, key := range opts.rootKeys(orgPK) {
+			ok, err := iu.Ed25519Verify(key, []byte(fmt.Sprintf("%s.%s%s", issuers[0].ID, issuers[0].PublicKey, grants[0])), sigs[0])
+			if err != nil {
+				return nil, newVerificationError(ErrChainSignatureInvalid, err, "org issuer signature validation failed: %s", err)
+			}
+			if ok {
+				rooted = true
+				break
+			}
+		}
+		if !rooted {
+			return nil, newVerificationError(ErrChainSignatureInvalid, nil, "invalid org issuer signature for chain issuer %s", issuers[0].ID)
+		}
+	}
+
+	for i := 1; i < len(issuers); i++ {
+		dat := fmt.Sprintf("%s.%s.%s%s", issuers[i].ID, issuers[i].PublicKey, strings.Join(segments[:i], "."), grants[i])
+		ok, err := iu.Ed25519Verify(keys[i-1], []byte(dat), sigs[i])
+		if err != nil {
+			return nil, newVerificationError(ErrChainSignatureInvalid, err, "chain signature validation failed: %s", err)
+		}
+		if !ok {
+			return nil, newVerificationError(ErrChainSignatureInvalid, nil, "invalid chain signature for chain issuer %s", issuers[i].ID)
+		}
+	}
+
+	last := len(issuers) - 1
+	tcs := strings.Join(segments[:len(issuers)], ".")
+
+	dat := fmt.Sprintf("%s.%s", c.ID, tcs)
+	if c.ChainDelegate {
+		grant, err := chainGrantData(c.ChainGrant)
+		if err != nil {
+			return nil, err
+		}
+
+		dat = fmt.Sprintf("%s.%s.%s%s", c.ID, c.PublicKey, tcs, grant)
+	}
+
+	// this is the signature from the issuer of the token
+	ok, err := iu.Ed25519Verify(keys[last], []byte(dat), sigs[last+1])
+	if err != nil {
+		return nil, newVerificationError(ErrChainSignatureInvalid, err, "chain signature validation failed: %s", err)
+	}
+	if !ok {
+		return nil, newVerificationError(ErrChainSignatureInvalid, nil, "invalid chain signature")
+	}
+
+	if opts.revocations != nil {
+		for _, ci := range issuers {
+			err = opts.revocations.checkChainIssuer(ci.ID, ci.PublicKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return keys[last], nil
+}
@@ -0,0 +1,277 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	iu "github.com/choria-io/go-choria/internal/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Chains", func() {
+	var (
+		orgPubK    ed25519.PublicKey
+		orgPriK    ed25519.PrivateKey
+		regional   *ClientIDClaims
+		regionPriK ed25519.PrivateKey
+		site       *ClientIDClaims
+		sitePriK   ed25519.PrivateKey
+		user       *ClientIDClaims
+		err        error
+	)
+
+	BeforeEach(func() {
+		orgPubK, orgPriK, err = iu.Ed25519KeyPair()
+		Expect(err).ToNot(HaveOccurred())
+
+		// org issuer -> regional aaa -> site login service -> user
+		regional, regionPriK = newTestClient("choria=regional", 3*time.Hour)
+		Expect(regional.AddOrgIssuerData(mustSigner(orgPriK))).To(Succeed())
+
+		site, sitePriK = newTestClient("choria=site", 2*time.Hour)
+		Expect(site.AddChainDelegateData(regional, mustSigner(regionPriK))).To(Succeed())
+
+		user, _ = newTestClient("choria=user", time.Hour)
+		Expect(user.AddChainIssuerData(site, mustSigner(sitePriK))).To(Succeed())
+	})
+
+	Describe("AddChainDelegateData", func() {
+		It("Should require the chain issuer signer", func() {
+			other, _ := newTestClient("choria=other", time.Hour)
+			Expect(other.AddChainDelegateData(regional, mustSigner(sitePriK))).To(MatchError("signer does not match the chain issuer public key"))
+		})
+
+		It("Should create a delegate", func() {
+			Expect(site.ChainDelegate).To(BeTrue())
+			Expect(site.Issuer).To(Equal("C-" + regional.ID + "." + regional.PublicKey))
+			Expect(site.IssuerChain).To(BeEmpty())
+			Expect(site.IsChainedIssuer(false)).To(BeTrue())
+			Expect(site.IsChainedIssuer(true)).To(BeTrue())
+
+			site.PublicKey = regional.PublicKey
+			Expect(site.IsChainedIssuer(true)).To(BeFalse())
+		})
+	})
+
+	Describe("SetChainIssuer", func() {
+		It("Should only allow delegates to extend the chain", func() {
+			other, _ := newTestClient("choria=other", time.Hour)
+			Expect(other.SetChainIssuer(user)).To(MatchError("issuer is not a chain delegate"))
+		})
+
+		It("Should record the chain and issuer expiry", func() {
+			Expect(user.Issuer).To(Equal("C-" + site.ID + "." + site.PublicKey))
+			Expect(user.IssuerChain).To(Equal([]ChainIssuer{{ID: regional.ID, PublicKey: regional.PublicKey}}))
+			Expect(user.IssuerExpiresAt.Time).To(Equal(site.ExpiresAt.Time))
+
+			issuers, err := user.ChainIssuers()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(issuers).To(Equal([]ChainIssuer{
+				{ID: regional.ID, PublicKey: regional.PublicKey},
+				{ID: site.ID, PublicKey: site.PublicKey},
+			}))
+		})
+
+		It("Should limit the issuer expiry to that of the entire chain", func() {
+			site, sitePriK = newTestClient("choria=site", 5*time.Hour)
+			Expect(site.AddChainDelegateData(regional, mustSigner(regionPriK))).To(Succeed())
+			Expect(site.ExpireTime()).To(Equal(regional.ExpiresAt.Time))
+
+			user, _ = newTestClient("choria=user", 4*time.Hour)
+			Expect(user.AddChainIssuerData(site, mustSigner(sitePriK))).To(Succeed())
+			Expect(user.IssuerExpiresAt.Time).To(Equal(regional.ExpiresAt.Time))
+			Expect(user.ExpireTime()).To(Equal(regional.ExpiresAt.Time))
+		})
+	})
+
+	Describe("IsSignedByIssuer", func() {
+		It("Should verify every link back to the org issuer", func() {
+			ok, pk, err := user.IsSignedByIssuer(orgPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(hex.EncodeToString(pk)).To(Equal(site.PublicKey))
+
+			ok, pk, err = site.IsSignedByIssuer(orgPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(hex.EncodeToString(pk)).To(Equal(regional.PublicKey))
+		})
+
+		It("Should detect chains not issued by the org issuer", func() {
+			otherPubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+
+			ok, _, err := user.IsSignedByIssuer(otherPubK)
+			Expect(err).To(MatchError("invalid org issuer signature for chain issuer " + regional.ID))
+			Expect(errors.Is(err, ErrChainSignatureInvalid)).To(BeTrue())
+			Expect(ok).To(BeFalse())
+		})
+
+		It("Should detect chain issuers not signed by the org issuer", func() {
+			otherPubK, otherPriK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+
+			handler, handlerPriK := newTestClient("choria=handler", time.Hour)
+			Expect(handler.AddOrgIssuerData(mustSigner(otherPriK))).To(Succeed())
+			handler.SetOrgIssuer(orgPubK)
+
+			other, _ := newTestClient("choria=other", time.Hour)
+			Expect(other.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+
+			ok, _, err := other.IsSignedByIssuer(orgPubK)
+			Expect(err).To(MatchError("invalid org issuer signature for chain issuer " + handler.ID))
+			Expect(ok).To(BeFalse())
+
+			ok, _, err = other.IsSignedByIssuer(otherPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+		})
+
+		It("Should detect tampered chains", func() {
+			rogue, roguePriK := newTestClient("choria=rogue", time.Hour)
+			user.IssuerChain[0].PublicKey = rogue.PublicKey
+			ok, _, err := user.IsSignedByIssuer(orgPubK)
+			Expect(err).To(MatchError("invalid org issuer signature for chain issuer " + regional.ID))
+			Expect(ok).To(BeFalse())
+
+			// a delegate made by a chain issuer not in the chain
+			Expect(site.AddChainDelegateData(rogue, mustSigner(roguePriK))).To(Succeed())
+			site.TrustChainSignature = regional.TrustChainSignature + site.TrustChainSignature[len(rogue.TrustChainSignature):]
+			site.Issuer = "C-" + regional.ID + "." + regional.PublicKey
+			ok, _, err = site.IsSignedByIssuer(orgPubK)
+			Expect(err).To(MatchError("invalid chain signature"))
+			Expect(ok).To(BeFalse())
+		})
+
+		It("Should detect non delegates issuing tokens", func() {
+			user.ChainDelegate = true
+			ok, _, err := user.IsSignedByIssuer(orgPubK)
+			Expect(err).To(MatchError("invalid chain signature"))
+			Expect(ok).To(BeFalse())
+		})
+
+		It("Should detect missing links", func() {
+			user.IssuerChain = nil
+			ok, _, err := user.IsSignedByIssuer(orgPubK)
+			Expect(err).To(MatchError("invalid trust chain signature"))
+			Expect(errors.Is(err, ErrMalformedChainData)).To(BeTrue())
+			Expect(ok).To(BeFalse())
+		})
+
+		It("Should enforce the maximum depth", func() {
+			ok, _, err := user.IsSignedByIssuer(orgPubK, WithMaxChainDepth(1))
+			Expect(err).To(MatchError("chain depth 2 exceeds the maximum of 1"))
+			Expect(errors.Is(err, ErrChainTooDeep)).To(BeTrue())
+			Expect(ok).To(BeFalse())
+
+			ok, _, err = user.IsSignedByIssuer(orgPubK, WithMaxChainDepth(2))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+
+			var priK = sitePriK
+			issuer := site
+			for i := 0; i < DefaultMaxChainDepth; i++ {
+				delegate, delegatePriK := newTestClient("choria=delegate", time.Hour)
+				Expect(delegate.AddChainDelegateData(issuer, mustSigner(priK))).To(Succeed())
+				issuer, priK = delegate, delegatePriK
+			}
+			Expect(issuer.IssuerChain).To(HaveLen(DefaultMaxChainDepth))
+
+			ok, _, err = issuer.IsSignedByIssuer(orgPubK)
+			Expect(err).To(MatchError("chain depth 5 exceeds the maximum of 4"))
+			Expect(ok).To(BeFalse())
+
+			ok, _, err = issuer.IsSignedByIssuer(orgPubK, WithMaxChainDepth(0))
+			Expect(err).To(MatchError("chain depth 5 exceeds the maximum of 1"))
+			Expect(ok).To(BeFalse())
+
+			ok, _, err = issuer.IsSignedByIssuer(orgPubK, WithMaxChainDepth(-1))
+			Expect(err).To(MatchError("chain depth 5 exceeds the maximum of 1"))
+			Expect(ok).To(BeFalse())
+
+			ok, _, err = issuer.IsSignedByIssuer(orgPubK, WithUnlimitedChainDepth())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+		})
+
+		It("Should reject tokens when any chain issuer is revoked", func() {
+			list, err := NewRevocationListClaims("", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(list.RevokeChainIssuer(regional.ID)).To(Succeed())
+
+			ok, _, err := user.IsSignedByIssuer(orgPubK, WithRevocations(list))
+			Expect(err).To(MatchError("chain issuer " + regional.ID + " has been revoked"))
+			Expect(ok).To(BeFalse())
+			Expect(list.CheckRevoked(&user.StandardClaims)).To(MatchError("chain issuer " + regional.ID + " has been revoked"))
+		})
+	})
+
+	Describe("Parsing", func() {
+		It("Should parse client tokens", func() {
+			t, err := SignToken(user, mustSigner(sitePriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			parsed, err := ParseClientIDToken(t, orgPubK, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed.CallerID).To(Equal("choria=user"))
+			Expect(parsed.IssuerChain).To(HaveLen(1))
+
+			_, err = ParseClientIDToken(t, orgPubK, true, WithMaxChainDepth(1))
+			Expect(errors.Is(err, ErrChainTooDeep)).To(BeTrue())
+
+			t, err = SignToken(site, mustSigner(regionPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			parsed, err = ParseClientIDToken(t, orgPubK, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed.ChainDelegate).To(BeTrue())
+		})
+
+		It("Should require client tokens to hold a public key", func() {
+			user.PublicKey = ""
+			t, err := SignToken(user, mustSigner(sitePriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseClientIDToken(t, orgPubK, true)
+			Expect(err).To(MatchError(ContainSubstring("no public key set")))
+			Expect(errors.Is(err, ErrMalformedChainData)).To(BeTrue())
+		})
+
+		It("Should parse server tokens", func() {
+			serverPubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			server, err := NewServerClaims("example.net", []string{"choria"}, "", nil, nil, serverPubK, "", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.AddChainIssuerData(site, mustSigner(sitePriK))).To(Succeed())
+
+			t, err := SignToken(server, mustSigner(sitePriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			parsed, err := ParseServerToken(t, orgPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed.ChainIssuers()).To(HaveLen(2))
+		})
+
+		It("Should support the verifier", func() {
+			t, err := SignToken(user, mustSigner(sitePriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			v, err := NewVerifier(WithTrustedKeys(orgPubK))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = v.VerifyClient(t)
+			Expect(err).ToNot(HaveOccurred())
+
+			v, err = NewVerifier(WithTrustedKeys(orgPubK), WithParseOptions(WithMaxChainDepth(1)))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = v.VerifyClient(t)
+			Expect(err).To(MatchError("could not parse client id token: not signed by issuer: chain depth 2 exceeds the maximum of 1"))
+		})
+	})
+})
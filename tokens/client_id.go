@@ -86,8 +86,8 @@ type ClientIDClaims struct {
 }
 
 var (
-	ErrNotAClientToken       = fmt.Errorf("not a client token")
-	ErrInvalidClientCallerID = fmt.Errorf("invalid caller id in token")
+	ErrNotAClientToken       error = newVerificationError(ErrWrongPurpose, nil, "not a client token")
+	ErrInvalidClientCallerID       = fmt.Errorf("invalid caller id in token")
 )
 
 // UniqueID returns the caller id and unique id used to generate private inboxes
@@ -187,9 +187,9 @@ func ParseClientIDTokenUnverified(token string) (*ClientIDClaims, error) {
 }
 
 // ParseClientIDToken parses token and verifies it with pk
-func ParseClientIDToken(token string, pk any, verifyPurpose bool) (*ClientIDClaims, error) {
+func ParseClientIDToken(token string, pk any, verifyPurpose bool, opts ...ParseOption) (*ClientIDClaims, error) {
 	claims := &ClientIDClaims{}
-	err := ParseToken(token, claims, pk)
+	err := ParseToken(token, claims, pk, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("could not parse client id token: %w", err)
 	}
@@ -198,18 +198,28 @@ func ParseClientIDToken(token string, pk any, verifyPurpose bool) (*ClientIDClai
 		return nil, ErrNotAClientToken
 	}
 
+	err = claims.verified()
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// verified performs the checks needed once the signature of the token was verified
+func (c *ClientIDClaims) verified() error {
 	// if we have a tcs we require an issuer expiry to be set and it to not have expired
-	if claims.TrustChainSignature != "" && strings.HasPrefix(claims.Issuer, ChainIssuerPrefix) {
-		if !claims.verifyIssuerExpiry(true) {
-			return nil, jwt.ErrTokenExpired
+	if c.TrustChainSignature != "" && strings.HasPrefix(c.Issuer, ChainIssuerPrefix) {
+		if !c.verifyIssuerExpiry(true) {
+			return errIssuerExpired
 		}
 	}
 
-	return claims, nil
+	return nil
 }
 
-// ParseClientIDTokenWithKeyfile parses token and verifies it with the RSA Public key in pkFile, does not support ed25519 public keys in a file
-func ParseClientIDTokenWithKeyfile(token string, pkFile string, verifyPurpose bool) (*ClientIDClaims, error) {
+// ParseClientIDTokenWithKeyfile parses token and verifies it with the RSA, ECDSA or ed25519 public key in pkFile
+func ParseClientIDTokenWithKeyfile(token string, pkFile string, verifyPurpose bool, opts ...ParseOption) (*ClientIDClaims, error) {
 	if pkFile == "" {
 		return nil, fmt.Errorf("invalid public key file")
 	}
@@ -219,10 +229,10 @@ func ParseClientIDTokenWithKeyfile(token string, pkFile string, verifyPurpose bo
 		return nil, fmt.Errorf("could not read validation certificate: %s", err)
 	}
 
-	pk, err := readRSAOrED25519PublicData(certdat)
+	pk, err := readPublicKeyData(certdat)
 	if err != nil {
 		return nil, err
 	}
 
-	return ParseClientIDToken(token, pk, verifyPurpose)
+	return ParseClientIDToken(token, pk, verifyPurpose, opts...)
 }
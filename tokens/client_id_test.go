@@ -39,13 +39,13 @@ var _ = Describe("ClientIDClaims", func() {
 		perms = &ClientPermissions{OrgAdmin: true}
 		claims, err := NewClientIDClaims("up=ginkgo", []string{"rpcutil"}, "choria", map[string]string{"group": "admins"}, "// opa policy", "Ginkgo", time.Hour, perms, pubK)
 		Expect(err).ToNot(HaveOccurred())
-		validToken, err = SignToken(claims, loadRSAPriKey("testdata/rsa/signer-key.pem"))
+		validToken, err = SignToken(claims, mustSigner(loadRSAPriKey("testdata/rsa/signer-key.pem")))
 		Expect(err).ToNot(HaveOccurred())
 
 		claims, err = NewClientIDClaims("up=ginkgo.expired", []string{"rpcutil"}, "choria", map[string]string{"group": "admins"}, "// opa policy", "Ginkgo", -1*time.Hour, perms, pubK)
 		Expect(err).ToNot(HaveOccurred())
 		claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-1 * time.Hour))
-		expiredToken, err = SignToken(claims, loadRSAPriKey("testdata/rsa/signer-key.pem"))
+		expiredToken, err = SignToken(claims, mustSigner(loadRSAPriKey("testdata/rsa/signer-key.pem")))
 		Expect(err).ToNot(HaveOccurred())
 
 		provToken, err = os.ReadFile("testdata/rsa/good-provisioning.jwt")
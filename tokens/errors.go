@@ -0,0 +1,113 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Classes of verification failure, use errors.Is to check if an error is of a certain class
+var (
+	// ErrIssuerMismatch indicates the token was not issued by the issuer it was verified against
+	ErrIssuerMismatch = errors.New("issuer mismatch")
+
+	// ErrChainSignatureInvalid indicates a signature in the trust chain did not validate
+	ErrChainSignatureInvalid = errors.New("chain signature invalid")
+
+	// ErrIssuerExpired indicates the chain issuer of a token has expired, also matches jwt.ErrTokenExpired
+	ErrIssuerExpired = errors.New("issuer expired")
+
+	// ErrWrongPurpose indicates a token was not of the expected purpose
+	ErrWrongPurpose = errors.New("wrong purpose")
+
+	// ErrBadKeyType indicates the key supplied for verification does not suit the token
+	ErrBadKeyType = errors.New("bad key type")
+
+	// ErrMalformedChainData indicates the issuer or trust chain data in a token is malformed or missing
+	ErrMalformedChainData = errors.New("malformed chain data")
+
+	// ErrChainTooDeep indicates the trust chain of a token holds more chain issuers than allowed
+	ErrChainTooDeep = errors.New("chain too deep")
+
+	// ErrExceedsGrant indicates a token holds more than the grant of one of its chain issuers allows
+	ErrExceedsGrant = errors.New("exceeds chain issuer grant")
+
+	// ErrRevoked indicates the token, its public key or its chain issuer appears in a revocation list
+	ErrRevoked = errors.New("revoked")
+
+	// ErrRevocationListExpired indicates the revocation list used for verification has expired and can not be trusted to be complete
+	ErrRevocationListExpired = errors.New("revocation list expired")
+
+	// ErrUntrustedOrganizationUnit indicates no keys are trusted for the organization unit of a token
+	ErrUntrustedOrganizationUnit = errors.New("untrusted organization unit")
+
+	// ErrRequestDenied indicates a token request is not allowed by the issuing policy
+	ErrRequestDenied = errors.New("request denied")
+
+	// ErrPossessionNotProven indicates a party presenting a token did not prove it holds the private key of the token public key
+	ErrPossessionNotProven = errors.New("possession not proven")
+)
+
+// VerificationError is a failure to verify a token, Kind is one of the error classes like ErrChainSignatureInvalid
+type VerificationError struct {
+	// Kind is the class of failure
+	Kind error
+
+	// Err is the underlying error, if any
+	Err error
+
+	msg string
+}
+
+// Error implements error
+func (e *VerificationError) Error() string {
+	switch {
+	case e.msg != "":
+		return e.msg
+	case e.Err != nil:
+		return fmt.Sprintf("%s: %s", e.Kind, e.Err)
+	default:
+		return e.Kind.Error()
+	}
+}
+
+// Is matches the class of the error, ErrIssuerExpired errors also match jwt.ErrTokenExpired for backwards compatibility
+func (e *VerificationError) Is(target error) bool {
+	if target == e.Kind {
+		return true
+	}
+
+	return e.Kind == ErrIssuerExpired && target == jwt.ErrTokenExpired
+}
+
+// Unwrap gives access to the underlying error
+func (e *VerificationError) Unwrap() error {
+	return e.Err
+}
+
+func newVerificationError(kind error, err error, format string, a ...any) *VerificationError {
+	return &VerificationError{Kind: kind, Err: err, msg: fmt.Sprintf(format, a...)}
+}
+
+func errMalformedChainData(format string, a ...any) error {
+	return newVerificationError(ErrMalformedChainData, nil, format, a...)
+}
+
+func errBadKeyType(format string, a ...any) error {
+	return newVerificationError(ErrBadKeyType, nil, format, a...)
+}
+
+func errNotSignedByIssuer(err error) error {
+	if err == nil {
+		return newVerificationError(ErrorNotSignedByIssuer, ErrChainSignatureInvalid, "%s", ErrorNotSignedByIssuer)
+	}
+
+	return newVerificationError(ErrorNotSignedByIssuer, err, "%s: %s", ErrorNotSignedByIssuer, err)
+}
+
+var errIssuerExpired = newVerificationError(ErrIssuerExpired, nil, "issuer has expired")
@@ -0,0 +1,148 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"time"
+
+	iu "github.com/choria-io/go-choria/internal/util"
+	"github.com/golang-jwt/jwt/v4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/segmentio/ksuid"
+)
+
+var _ = Describe("Errors", func() {
+	Describe("VerificationError", func() {
+		It("Should support errors.Is and errors.As", func() {
+			cause := fmt.Errorf("cause")
+			err := fmt.Errorf("wrapped: %w", newVerificationError(ErrChainSignatureInvalid, cause, "failed: %s", cause))
+
+			Expect(err).To(MatchError("wrapped: failed: cause"))
+			Expect(errors.Is(err, ErrChainSignatureInvalid)).To(BeTrue())
+			Expect(errors.Is(err, cause)).To(BeTrue())
+			Expect(errors.Is(err, ErrIssuerMismatch)).To(BeFalse())
+
+			var verr *VerificationError
+			Expect(errors.As(err, &verr)).To(BeTrue())
+			Expect(verr.Kind).To(Equal(ErrChainSignatureInvalid))
+			Expect(verr.Err).To(Equal(cause))
+		})
+
+		It("Should have a default message", func() {
+			Expect((&VerificationError{Kind: ErrBadKeyType}).Error()).To(Equal("bad key type"))
+			Expect((&VerificationError{Kind: ErrBadKeyType, Err: fmt.Errorf("cause")}).Error()).To(Equal("bad key type: cause"))
+		})
+
+		It("Should match expired issuers as expired tokens", func() {
+			Expect(errors.Is(errIssuerExpired, ErrIssuerExpired)).To(BeTrue())
+			Expect(errors.Is(errIssuerExpired, jwt.ErrTokenExpired)).To(BeTrue())
+		})
+	})
+
+	Describe("Token verification", func() {
+		var (
+			orgPubK     ed25519.PublicKey
+			orgPriK     ed25519.PrivateKey
+			handler     *ClientIDClaims
+			handlerPriK ed25519.PrivateKey
+			user        *ClientIDClaims
+			err         error
+		)
+
+		BeforeEach(func() {
+			orgPubK, orgPriK, err = iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+
+			var handlerPubK ed25519.PublicKey
+			handlerPubK, handlerPriK, err = iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+
+			handler, err = NewClientIDClaims("choria=handler", nil, "", nil, "", "", time.Hour, nil, handlerPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(handler.AddOrgIssuerData(mustSigner(orgPriK))).To(Succeed())
+
+			userPubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			user, err = NewClientIDClaims("choria=user", nil, "", nil, "", "", time.Hour, nil, userPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(user.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+		})
+
+		It("Should detect bad key types", func() {
+			t, err := SignToken(user, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseClientIDToken(t, loadRSAPubKey("testdata/rsa/signer-public.pem"), true)
+			Expect(err).To(MatchError("could not parse client id token: ed25519 public key required"))
+			Expect(errors.Is(err, ErrBadKeyType)).To(BeTrue())
+		})
+
+		It("Should detect the wrong purpose", func() {
+			t, err := SignToken(user, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseServerToken(t, orgPubK)
+			Expect(err).To(MatchError(ErrNotAServerToken))
+			Expect(errors.Is(err, ErrWrongPurpose)).To(BeTrue())
+
+			t, err = SignToken(handler, mustSigner(orgPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseProvisioningToken(t, orgPubK)
+			Expect(err).To(MatchError("not a provisioning token"))
+			Expect(errors.Is(err, ErrNotAProvisioningToken)).To(BeTrue())
+			Expect(errors.Is(err, ErrWrongPurpose)).To(BeTrue())
+		})
+
+		It("Should detect issuer mismatches", func() {
+			otherPubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+
+			_, _, err = handler.IsSignedByIssuer(otherPubK)
+			Expect(err).To(MatchError("public keys do not match"))
+			Expect(errors.Is(err, ErrIssuerMismatch)).To(BeTrue())
+		})
+
+		It("Should detect invalid chain signatures", func() {
+			user.ID = ksuid.New().String()
+			t, err := SignToken(user, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseClientIDToken(t, orgPubK, true)
+			Expect(err).To(MatchError("could not parse client id token: not signed by issuer: invalid chain signature"))
+			Expect(errors.Is(err, ErrorNotSignedByIssuer)).To(BeTrue())
+			Expect(errors.Is(err, ErrChainSignatureInvalid)).To(BeTrue())
+		})
+
+		It("Should detect malformed chain data", func() {
+			user.IssuerExpiresAt = nil
+			t, err := SignToken(user, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseClientIDToken(t, orgPubK, true)
+			Expect(err).To(MatchError("could not parse client id token: not signed by issuer: no issuer expires set"))
+			Expect(errors.Is(err, ErrMalformedChainData)).To(BeTrue())
+
+			var verr *VerificationError
+			Expect(errors.As(err, &verr)).To(BeTrue())
+			Expect(verr.Kind).To(Equal(ErrorNotSignedByIssuer))
+		})
+
+		It("Should detect expired issuers", func() {
+			user.IssuerExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+			t, err := SignToken(user, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseClientIDToken(t, orgPubK, true)
+			Expect(err).To(MatchError("issuer has expired"))
+			Expect(errors.Is(err, ErrIssuerExpired)).To(BeTrue())
+			Expect(errors.Is(err, jwt.ErrTokenExpired)).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,62 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"fmt"
+)
+
+// ExchangeProvisioningToken issues a server token to a node that presents a provisioning token along with its
+// server token request.
+//
+// The provisioning token is verified using pk and opts, the issued token is placed in the organization unit of the
+// provisioning token which the request has to match. Only provisioning tokens that enable protocol version 2 can be
+// exchanged and nodes that policy reports as provisioned, or all nodes when the policy can not report it, require a
+// provisioning token that allows updates.
+func ExchangeProvisioningToken(provisioningToken string, pk any, request string, policy *ServerTokenPolicy, signer Signer, opts ...ParseOption) (string, *ServerClaims, error) {
+	if policy == nil {
+		return "", nil, fmt.Errorf("policy is required")
+	}
+
+	prov, err := ParseProvisioningToken(provisioningToken, pk, opts...)
+	if err != nil {
+		return "", nil, err
+	}
+
+	req, err := ParseServerTokenRequest(request)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if !prov.ProtoV2 {
+		return "", nil, newVerificationError(ErrRequestDenied, nil, "provisioning token does not enable protocol version 2")
+	}
+
+	if req.OrganizationUnit != prov.OrganizationUnit {
+		return "", nil, newVerificationError(ErrRequestDenied, nil, "organization unit %s does not match provisioning organization unit %s", req.OrganizationUnit, prov.OrganizationUnit)
+	}
+
+	err = policy.Validate(req)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if !prov.AllowUpdate {
+		if policy.Provisioned == nil {
+			return "", nil, newVerificationError(ErrRequestDenied, nil, "the policy can not determine if %s is provisioned and the provisioning token does not allow updates", req.ChoriaIdentity)
+		}
+
+		provisioned, err := policy.Provisioned(req.ChoriaIdentity)
+		if err != nil {
+			return "", nil, fmt.Errorf("could not determine if %s is provisioned: %w", req.ChoriaIdentity, err)
+		}
+
+		if provisioned {
+			return "", nil, newVerificationError(ErrRequestDenied, nil, "%s is already provisioned and the provisioning token does not allow updates", req.ChoriaIdentity)
+		}
+	}
+
+	return policy.issue(req, prov.OrganizationUnit, signer)
+}
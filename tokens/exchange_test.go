@@ -0,0 +1,134 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"time"
+
+	iu "github.com/choria-io/go-choria/internal/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ExchangeProvisioningToken", func() {
+	var (
+		nodePubK ed25519.PublicKey
+		nodePriK ed25519.PrivateKey
+		prov     *ProvisioningClaims
+		policy   *ServerTokenPolicy
+		signer   Signer
+		provPK   any
+		err      error
+	)
+
+	newRequest := func(org string) string {
+		req, err := NewServerTokenRequestClaims("n1.example.net", []string{"choria"}, org, nodePubK, 0)
+		Expect(err).ToNot(HaveOccurred())
+		t, err := SignToken(req, mustSigner(nodePriK))
+		Expect(err).ToNot(HaveOccurred())
+		return t
+	}
+
+	provToken := func() string {
+		t, err := SignToken(prov, signer)
+		Expect(err).ToNot(HaveOccurred())
+		return t
+	}
+
+	BeforeEach(func() {
+		nodePubK, nodePriK, err = iu.Ed25519KeyPair()
+		Expect(err).ToNot(HaveOccurred())
+
+		signer = mustSigner(loadRSAPriKey("testdata/rsa/signer-key.pem"))
+		provPK = loadRSAPubKey("testdata/rsa/signer-public.pem")
+
+		prov, err = NewProvisioningClaims(true, true, "x", "", "", []string{"nats://example.net:4222"}, "", "", "", "acme", "Ginkgo", time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		prov.ProtoV2 = true
+
+		policy = &ServerTokenPolicy{
+			Identities:        []string{"*.example.net"},
+			Collectives:       []string{"choria"},
+			OrganizationUnits: []string{"*"},
+			Validity:          time.Hour,
+			Provisioned:       func(string) (bool, error) { return false, nil },
+		}
+	})
+
+	It("Should issue server tokens in the provisioning organization unit", func() {
+		t, claims, err := ExchangeProvisioningToken(provToken(), provPK, newRequest("acme"), policy, signer)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(claims.OrganizationUnit).To(Equal("acme"))
+
+		server, err := ParseServerToken(t, provPK)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(server.ChoriaIdentity).To(Equal("n1.example.net"))
+		Expect(server.OrganizationUnit).To(Equal("acme"))
+		Expect(server.IsMatchingPublicKey(nodePubK)).To(BeTrue())
+	})
+
+	It("Should verify the provisioning token", func() {
+		_, _, err := ExchangeProvisioningToken(provToken(), loadRSAPubKey("testdata/rsa/other-public.pem"), newRequest("acme"), policy, signer)
+		Expect(err).To(MatchError("could not parse provisioner token: crypto/rsa: verification error"))
+
+		_, _, err = ExchangeProvisioningToken(newRequest("acme"), provPK, newRequest("acme"), policy, signer)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Should require protocol version 2", func() {
+		prov.ProtoV2 = false
+		_, _, err := ExchangeProvisioningToken(provToken(), provPK, newRequest("acme"), policy, signer)
+		Expect(err).To(MatchError("provisioning token does not enable protocol version 2"))
+		Expect(errors.Is(err, ErrRequestDenied)).To(BeTrue())
+	})
+
+	It("Should require the request to match the organization unit", func() {
+		_, _, err := ExchangeProvisioningToken(provToken(), provPK, newRequest(""), policy, signer)
+		Expect(err).To(MatchError("organization unit choria does not match provisioning organization unit acme"))
+		Expect(errors.Is(err, ErrRequestDenied)).To(BeTrue())
+	})
+
+	It("Should enforce the policy", func() {
+		policy.OrganizationUnits = []string{"choria"}
+		_, _, err := ExchangeProvisioningToken(provToken(), provPK, newRequest("acme"), policy, signer)
+		Expect(err).To(MatchError("organization unit acme is not allowed"))
+	})
+
+	It("Should only update provisioned nodes when allowed", func() {
+		policy.Provisioned = func(identity string) (bool, error) {
+			return identity == "n1.example.net", nil
+		}
+
+		_, _, err := ExchangeProvisioningToken(provToken(), provPK, newRequest("acme"), policy, signer)
+		Expect(err).To(MatchError("n1.example.net is already provisioned and the provisioning token does not allow updates"))
+		Expect(errors.Is(err, ErrRequestDenied)).To(BeTrue())
+
+		prov.AllowUpdate = true
+		_, _, err = ExchangeProvisioningToken(provToken(), provPK, newRequest("acme"), policy, signer)
+		Expect(err).ToNot(HaveOccurred())
+
+		prov.AllowUpdate = false
+		policy.Provisioned = func(identity string) (bool, error) {
+			return false, fmt.Errorf("lookup failed")
+		}
+		_, _, err = ExchangeProvisioningToken(provToken(), provPK, newRequest("acme"), policy, signer)
+		Expect(err).To(MatchError("could not determine if n1.example.net is provisioned: lookup failed"))
+	})
+
+	It("Should require updates to be allowed when the policy can not determine if nodes are provisioned", func() {
+		policy.Provisioned = nil
+
+		_, _, err := ExchangeProvisioningToken(provToken(), provPK, newRequest("acme"), policy, signer)
+		Expect(err).To(MatchError("the policy can not determine if n1.example.net is provisioned and the provisioning token does not allow updates"))
+		Expect(errors.Is(err, ErrRequestDenied)).To(BeTrue())
+
+		prov.AllowUpdate = true
+		_, _, err = ExchangeProvisioningToken(provToken(), provPK, newRequest("acme"), policy, signer)
+		Expect(err).ToNot(HaveOccurred())
+	})
+})
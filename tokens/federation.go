@@ -0,0 +1,165 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Federation maps organization units to the keys trusted to issue tokens for them, it can be passed to ParseToken
+// and related functions in place of a single public key.
+//
+// Tokens are only accepted when signed by a key trusted for the organization unit they claim, tokens without an
+// organization unit belong to the choria organization unit.
+type Federation struct {
+	orgs    map[string]*Keyring
+	version uint64
+	mu      sync.RWMutex
+}
+
+// NewFederation creates a new, empty, Federation
+func NewFederation() *Federation {
+	return &Federation{orgs: make(map[string]*Keyring)}
+}
+
+// AddTrustedKeys adds keys to those trusted to issue tokens for the organization unit ou
+func (f *Federation) AddTrustedKeys(ou string, keys ...crypto.PublicKey) error {
+	if ou == "" {
+		return fmt.Errorf("organization unit is required")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keyring, ok := f.orgs[ou]
+	if !ok {
+		keyring = &Keyring{}
+	}
+
+	for _, key := range keys {
+		err := keyring.Add(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	f.orgs[ou] = keyring
+	f.version = nextTrustVersion()
+
+	return nil
+}
+
+// SetKeyring trusts the keys in keyring to issue tokens for the organization unit ou, changes to the keyring will be used by the federation
+func (f *Federation) SetKeyring(ou string, keyring *Keyring) error {
+	if ou == "" {
+		return fmt.Errorf("organization unit is required")
+	}
+	if keyring == nil {
+		return fmt.Errorf("keyring is required")
+	}
+
+	f.mu.Lock()
+	f.orgs[ou] = keyring
+	f.version = nextTrustVersion()
+	f.mu.Unlock()
+
+	return nil
+}
+
+// RemoveOrganizationUnit stops trusting any keys for the organization unit ou
+func (f *Federation) RemoveOrganizationUnit(ou string) {
+	f.mu.Lock()
+	delete(f.orgs, ou)
+	f.version = nextTrustVersion()
+	f.mu.Unlock()
+}
+
+// trustVersion changes whenever organization units are added, replaced or removed or their keyrings change
+func (f *Federation) trustVersion() uint64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	version := f.version
+	for _, keyring := range f.orgs {
+		if v := keyring.trustVersion(); v > version {
+			version = v
+		}
+	}
+
+	return version
+}
+
+// Keyring is the keyring holding the keys trusted for the organization unit ou
+func (f *Federation) Keyring(ou string) (*Keyring, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	keyring, ok := f.orgs[ou]
+
+	return keyring, ok
+}
+
+// OrganizationUnits are the names of all organization units with trusted keys
+func (f *Federation) OrganizationUnits() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	ous := make([]string, 0, len(f.orgs))
+	for ou := range f.orgs {
+		ous = append(ous, ou)
+	}
+	sort.Strings(ous)
+
+	return ous
+}
+
+// Len is the number of organization units with trusted keys
+func (f *Federation) Len() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return len(f.orgs)
+}
+
+// parseTokenWithFederation verifies token using the keys trusted for the organization unit the token claims
+func parseTokenWithFederation(d *decodedToken, f *Federation, opts *parseOpts) error {
+	unverified := struct {
+		OU any `json:"ou"`
+	}{}
+	err := json.Unmarshal(d.claimsData, &unverified)
+	if err != nil {
+		return err
+	}
+
+	ou := defaultOrg
+	if unverified.OU != nil {
+		s, ok := unverified.OU.(string)
+		if !ok {
+			return fmt.Errorf("invalid organization unit in token")
+		}
+		if s != "" {
+			ou = s
+		}
+	}
+
+	keyring, ok := f.Keyring(ou)
+	if !ok || keyring.Len() == 0 {
+		return newVerificationError(ErrUntrustedOrganizationUnit, nil, "no trusted keys for organization unit %s", ou)
+	}
+
+	err = parseTokenWithKeyring(d, keyring, opts)
+	if errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+		return newVerificationError(ErrIssuerMismatch, err, "not signed by a trusted issuer for organization unit %s: %s", ou, err)
+	}
+
+	return err
+}
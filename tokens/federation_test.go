@@ -0,0 +1,151 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"time"
+
+	iu "github.com/choria-io/go-choria/internal/util"
+	"github.com/golang-jwt/jwt/v4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Federation", func() {
+	var (
+		fed        *Federation
+		choriaPubK ed25519.PublicKey
+		choriaPriK ed25519.PrivateKey
+		acmePubK   ed25519.PublicKey
+		acmePriK   ed25519.PrivateKey
+		err        error
+	)
+
+	BeforeEach(func() {
+		choriaPubK, choriaPriK, err = iu.Ed25519KeyPair()
+		Expect(err).ToNot(HaveOccurred())
+		acmePubK, acmePriK, err = iu.Ed25519KeyPair()
+		Expect(err).ToNot(HaveOccurred())
+
+		fed = NewFederation()
+		Expect(fed.AddTrustedKeys("choria", choriaPubK)).To(Succeed())
+		Expect(fed.AddTrustedKeys("acme", acmePubK)).To(Succeed())
+	})
+
+	Describe("AddTrustedKeys", func() {
+		It("Should manage keys per organization unit", func() {
+			Expect(fed.AddTrustedKeys("", acmePubK)).To(MatchError("organization unit is required"))
+			Expect(fed.AddTrustedKeys("acme", "x")).To(MatchError("unsupported public key type string"))
+
+			Expect(fed.AddTrustedKeys("acme", loadRSAPubKey("testdata/rsa/signer-public.pem"))).To(Succeed())
+			Expect(fed.OrganizationUnits()).To(Equal([]string{"acme", "choria"}))
+			Expect(fed.Len()).To(Equal(2))
+
+			kr, ok := fed.Keyring("acme")
+			Expect(ok).To(BeTrue())
+			Expect(kr.Len()).To(Equal(2))
+
+			fed.RemoveOrganizationUnit("acme")
+			_, ok = fed.Keyring("acme")
+			Expect(ok).To(BeFalse())
+			Expect(fed.OrganizationUnits()).To(Equal([]string{"choria"}))
+		})
+	})
+
+	Describe("SetKeyring", func() {
+		It("Should use the supplied keyring", func() {
+			Expect(fed.SetKeyring("", &Keyring{})).To(MatchError("organization unit is required"))
+			Expect(fed.SetKeyring("other", nil)).To(MatchError("keyring is required"))
+
+			kr := &Keyring{}
+			Expect(fed.SetKeyring("other", kr)).To(Succeed())
+			t := newTestClientToken("other", mustSigner(acmePriK))
+
+			_, err := ParseClientIDToken(t, fed, true)
+			Expect(errors.Is(err, ErrUntrustedOrganizationUnit)).To(BeTrue())
+
+			Expect(kr.Add(acmePubK)).To(Succeed())
+			_, err = ParseClientIDToken(t, fed, true)
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Describe("ParseToken", func() {
+		It("Should accept tokens signed by the issuer of their organization unit", func() {
+			client, err := ParseClientIDToken(newTestClientToken("acme", mustSigner(acmePriK)), fed, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.OrganizationUnit).To(Equal("acme"))
+
+			client, err = ParseClientIDToken(newTestClientToken("", mustSigner(choriaPriK)), fed, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.OrganizationUnit).To(Equal("choria"))
+		})
+
+		It("Should reject cross organization tokens", func() {
+			_, err := ParseClientIDToken(newTestClientToken("acme", mustSigner(choriaPriK)), fed, true)
+			Expect(err).To(MatchError("could not parse client id token: not signed by a trusted issuer for organization unit acme: ed25519: verification error"))
+			Expect(errors.Is(err, ErrIssuerMismatch)).To(BeTrue())
+			Expect(errors.Is(err, jwt.ErrTokenSignatureInvalid)).To(BeTrue())
+
+			_, err = ParseClientIDToken(newTestClientToken("choria", mustSigner(acmePriK)), fed, true)
+			Expect(errors.Is(err, ErrIssuerMismatch)).To(BeTrue())
+		})
+
+		It("Should reject tokens for unknown organization units", func() {
+			_, err := ParseClientIDToken(newTestClientToken("other", mustSigner(acmePriK)), fed, true)
+			Expect(err).To(MatchError("could not parse client id token: no trusted keys for organization unit other"))
+			Expect(errors.Is(err, ErrUntrustedOrganizationUnit)).To(BeTrue())
+		})
+
+		It("Should verify chains against the issuer of the organization unit", func() {
+			handlerPubK, handlerPriK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			handler, err := NewClientIDClaims("acme=login", nil, "acme", nil, "", "", time.Hour, nil, handlerPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(handler.AddOrgIssuerData(mustSigner(acmePriK))).To(Succeed())
+
+			issue := func(ou string) string {
+				pubK, _, err := iu.Ed25519KeyPair()
+				Expect(err).ToNot(HaveOccurred())
+				user, err := NewClientIDClaims("acme=user", nil, ou, nil, "", "", time.Hour, nil, pubK)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(user.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+
+				t, err := SignToken(user, mustSigner(handlerPriK))
+				Expect(err).ToNot(HaveOccurred())
+				return t
+			}
+
+			_, err = ParseClientIDToken(issue("acme"), fed, true)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseClientIDToken(issue("choria"), fed, true)
+			Expect(errors.Is(err, ErrChainSignatureInvalid)).To(BeTrue())
+		})
+	})
+
+	Describe("Verifier", func() {
+		It("Should not combine keys and a federation", func() {
+			_, err := NewVerifier(WithFederation(fed), WithTrustedKeys(acmePubK))
+			Expect(err).To(MatchError("trusted keys can not be combined with a federation"))
+
+			_, err = NewVerifier(WithFederation(nil))
+			Expect(err).To(MatchError("federation is required"))
+		})
+
+		It("Should verify using the federation", func() {
+			v, err := NewVerifier(WithFederation(fed))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = v.VerifyClient(newTestClientToken("acme", mustSigner(acmePriK)))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = v.VerifyClient(newTestClientToken("acme", mustSigner(choriaPriK)))
+			Expect(errors.Is(err, ErrIssuerMismatch)).To(BeTrue())
+		})
+	})
+})
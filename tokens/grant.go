@@ -0,0 +1,320 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// ChainGrant is the maximum a chain issuer may delegate to the tokens it issues, tokens issued
+// by the chain issuer, or any delegates it created, may not exceed the grant.
+//
+// Everything not listed in the grant is denied, * allows all agents or organization units
+type ChainGrant struct {
+	// CallerIDs are patterns the caller id of issued clients must match, like okta=*, where * matches any characters, including /, and ? any single character
+	CallerIDs []string `json:"callerids,omitempty"`
+
+	// Identities are patterns the identity of issued servers must match, like *.dc1.example.net, see CallerIDs
+	Identities []string `json:"identities,omitempty"`
+
+	// Permissions are the client permissions issued clients may hold
+	Permissions *ClientPermissions `json:"permissions,omitempty"`
+
+	// ServerPermissions are the server permissions issued servers may hold
+	ServerPermissions *ServerPermissions `json:"server_permissions,omitempty"`
+
+	// Agents are the agents, or agent.action, issued clients may be allowed
+	Agents []string `json:"agents,omitempty"`
+
+	// OrganizationUnits are the organization units issued tokens may belong to
+	OrganizationUnits []string `json:"ous,omitempty"`
+
+	// Subjects are the additional subjects issued tokens may publish or subscribe to, NATS wildcards are supported with > allowing all
+	Subjects []string `json:"subjects,omitempty"`
+
+	// Provisioning allows provisioning tokens to be issued
+	Provisioning bool `json:"provisioning,omitempty"`
+}
+
+// hash is the sha256 hash of the grant that is included in the data signed for chain issuers
+func (g *ChainGrant) hash() (string, error) {
+	dat, err := json.Marshal(g)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(dat)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ValidateClient checks that client does not exceed the grant
+func (g *ChainGrant) ValidateClient(client *ClientIDClaims) error {
+	if !matchesAnyPattern(g.CallerIDs, client.CallerID) {
+		return errExceedsGrant("caller id %s is not granted", client.CallerID)
+	}
+
+	err := g.validatePermissions(g.Permissions, client.Permissions)
+	if err != nil {
+		return err
+	}
+
+	if client.OPAPolicy != "" && !g.allowsAgent("*") {
+		return errExceedsGrant("opa policies require all agents to be granted")
+	}
+
+	for _, agent := range client.AllowedAgents {
+		if !g.allowsAgent(agent) {
+			return errExceedsGrant("agent %s is not granted", agent)
+		}
+	}
+
+	err = g.validateOrganizationUnit(client.OrganizationUnit)
+	if err != nil {
+		return err
+	}
+
+	for _, subject := range client.AdditionalPublishSubjects {
+		err = g.validateSubject(subject)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, subject := range client.AdditionalSubscribeSubjects {
+		err = g.validateSubject(subject)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ValidateServer checks that server does not exceed the grant
+func (g *ChainGrant) ValidateServer(server *ServerClaims) error {
+	if !matchesAnyPattern(g.Identities, server.ChoriaIdentity) {
+		return errExceedsGrant("identity %s is not granted", server.ChoriaIdentity)
+	}
+
+	err := g.validatePermissions(g.ServerPermissions, server.Permissions)
+	if err != nil {
+		return err
+	}
+
+	err = g.validateOrganizationUnit(server.OrganizationUnit)
+	if err != nil {
+		return err
+	}
+
+	for _, subject := range server.AdditionalPublishSubjects {
+		err = g.validateSubject(subject)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ValidateProvisioning checks that prov does not exceed the grant
+func (g *ChainGrant) ValidateProvisioning(prov *ProvisioningClaims) error {
+	if !g.Provisioning {
+		return errExceedsGrant("provisioning tokens are not granted")
+	}
+
+	return g.validateOrganizationUnit(prov.OrganizationUnit)
+}
+
+// validatePermissions ensures that no permission is set in perms unless it is also set in granted,
+// both must be pointers to the same permissions struct type
+func (g *ChainGrant) validatePermissions(granted any, perms any) error {
+	pv := reflect.ValueOf(perms)
+	if pv.IsNil() {
+		return nil
+	}
+	pv = pv.Elem()
+
+	gv := reflect.ValueOf(granted)
+	hasGrant := !gv.IsNil()
+	if hasGrant {
+		gv = gv.Elem()
+	}
+
+	for i := 0; i < pv.NumField(); i++ {
+		if pv.Field(i).Kind() != reflect.Bool || !pv.Field(i).Bool() {
+			continue
+		}
+
+		if hasGrant && gv.Field(i).Bool() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(pv.Type().Field(i).Tag.Get("json"), ",")
+		return errExceedsGrant("permission %s is not granted", name)
+	}
+
+	return nil
+}
+
+func (g *ChainGrant) validateOrganizationUnit(ou string) error {
+	if ou == "" {
+		ou = defaultOrg
+	}
+
+	if stringInList(g.OrganizationUnits, "*") || stringInList(g.OrganizationUnits, ou) {
+		return nil
+	}
+
+	return errExceedsGrant("organization unit %s is not granted", ou)
+}
+
+func (g *ChainGrant) validateSubject(subject string) error {
+	for _, granted := range g.Subjects {
+		if subjectIsSubset(granted, subject) {
+			return nil
+		}
+	}
+
+	return errExceedsGrant("subject %s is not granted", subject)
+}
+
+// allowsAgent checks if agent, in agent or agent.action format, is covered by the granted agents
+func (g *ChainGrant) allowsAgent(agent string) bool {
+	if stringInList(g.Agents, "*") || stringInList(g.Agents, agent) {
+		return true
+	}
+
+	name, _, found := strings.Cut(agent, ".")
+	if found && stringInList(g.Agents, name) {
+		return true
+	}
+
+	return false
+}
+
+// matchesAnyPattern determines if s matches any of the patterns, see matchPattern
+func matchesAnyPattern(patterns []string, s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, pattern := range patterns {
+		if matchPattern(pattern, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchPattern determines if s matches pattern where * matches any characters, including none, and ? matches
+// any single character, unlike path.Match no character is treated as a separator
+func matchPattern(pattern string, s string) bool {
+	p := []rune(pattern)
+	r := []rune(s)
+
+	// star and mark record the last * seen and the position in s it is matching up to, for backtracking
+	pi, ri, star, mark := 0, 0, -1, 0
+	for ri < len(r) {
+		switch {
+		case pi < len(p) && (p[pi] == '?' || p[pi] == r[ri]):
+			pi++
+			ri++
+		case pi < len(p) && p[pi] == '*':
+			star, mark = pi, ri
+			pi++
+		case star != -1:
+			mark++
+			pi, ri = star+1, mark
+		default:
+			return false
+		}
+	}
+
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+
+	return pi == len(p)
+}
+
+// subjectIsSubset determines if every subject matched by subject is also matched by pattern using NATS wildcard rules
+func subjectIsSubset(pattern string, subject string) bool {
+	ptokens := strings.Split(pattern, ".")
+	stokens := strings.Split(subject, ".")
+
+	for i, pt := range ptokens {
+		if pt == ">" {
+			return i < len(stokens)
+		}
+
+		if i >= len(stokens) {
+			return false
+		}
+
+		switch {
+		case stokens[i] == ">":
+			return false
+		case pt == "*":
+			continue
+		case pt != stokens[i]:
+			return false
+		}
+	}
+
+	return len(ptokens) == len(stokens)
+}
+
+func errExceedsGrant(format string, a ...any) error {
+	return newVerificationError(ErrExceedsGrant, nil, format, a...)
+}
+
+// validateChainGrants checks claims against the grants of their chain issuers using the grant validator registered for
+// their purpose, claims of purposes that can not be chain issued are denied when any chain issuer has a grant
+func validateChainGrants(claims Claims) error {
+	def := purposeForClaims(claims)
+
+	return claims.standardClaims().eachChainGrant(func(ci ChainIssuer) error {
+		if def == nil || def.ValidateGrant == nil {
+			return errExceedsGrant("%T tokens are not allowed by chain issuer %s", claims, ci.ID)
+		}
+
+		err := def.ValidateGrant(claims, ci.Grant)
+		if err != nil {
+			return newVerificationError(ErrExceedsGrant, err, "%s by chain issuer %s", err, ci.ID)
+		}
+		return nil
+	})
+}
+
+// eachChainGrant calls cb for every chain issuer in the trust chain that has a grant
+func (c *StandardClaims) eachChainGrant(cb func(ci ChainIssuer) error) error {
+	if !strings.HasPrefix(c.Issuer, ChainIssuerPrefix) {
+		return nil
+	}
+
+	issuers, err := c.ChainIssuers()
+	if err != nil {
+		return err
+	}
+
+	for _, ci := range issuers {
+		if ci.Grant == nil {
+			continue
+		}
+
+		err = cb(ci)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
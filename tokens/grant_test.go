@@ -0,0 +1,351 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	iu "github.com/choria-io/go-choria/internal/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ChainGrant", func() {
+	var (
+		grant  *ChainGrant
+		client *ClientIDClaims
+		server *ServerClaims
+		err    error
+	)
+
+	BeforeEach(func() {
+		grant = &ChainGrant{
+			CallerIDs:         []string{"up=*"},
+			Identities:        []string{"*.net"},
+			Permissions:       &ClientPermissions{StreamsUser: true, FleetManagement: true},
+			ServerPermissions: &ServerPermissions{Submission: true},
+			Agents:            []string{"rpcutil", "puppet.status"},
+			OrganizationUnits: []string{"choria"},
+			Subjects:          []string{"custom.>", "other.*.x"},
+		}
+
+		client, err = NewClientIDClaims("up=ginkgo", []string{"rpcutil.ping", "puppet.status"}, "", nil, "", "", time.Hour, &ClientPermissions{FleetManagement: true}, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		pubK, _, err := iu.Ed25519KeyPair()
+		Expect(err).ToNot(HaveOccurred())
+		server, err = NewServerClaims("example.net", []string{"choria"}, "", &ServerPermissions{Submission: true}, []string{"custom.registration"}, pubK, "", time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Describe("ValidateClient", func() {
+		It("Should accept clients within the grant", func() {
+			client.AdditionalPublishSubjects = []string{"custom.x.y", "other.y.x"}
+			client.AdditionalSubscribeSubjects = []string{"custom.>"}
+			Expect(grant.ValidateClient(client)).To(Succeed())
+		})
+
+		It("Should check permissions", func() {
+			client.Permissions.OrgAdmin = true
+			err := grant.ValidateClient(client)
+			Expect(err).To(MatchError("permission org_admin is not granted"))
+			Expect(errors.Is(err, ErrExceedsGrant)).To(BeTrue())
+
+			grant.Permissions = nil
+			client.Permissions = &ClientPermissions{StreamsUser: true}
+			Expect(grant.ValidateClient(client)).To(MatchError("permission streams_user is not granted"))
+
+			client.Permissions = &ClientPermissions{}
+			Expect(grant.ValidateClient(client)).To(Succeed())
+		})
+
+		It("Should check agents", func() {
+			client.AllowedAgents = []string{"puppet"}
+			Expect(grant.ValidateClient(client)).To(MatchError("agent puppet is not granted"))
+
+			client.AllowedAgents = []string{"puppet.disable"}
+			Expect(grant.ValidateClient(client)).To(MatchError("agent puppet.disable is not granted"))
+
+			client.AllowedAgents = []string{"*"}
+			Expect(grant.ValidateClient(client)).To(MatchError("agent * is not granted"))
+
+			grant.Agents = []string{"*"}
+			Expect(grant.ValidateClient(client)).To(Succeed())
+		})
+
+		It("Should only allow opa policies when all agents are granted", func() {
+			client.OPAPolicy = "package io.choria.aaasvc"
+			Expect(grant.ValidateClient(client)).To(MatchError("opa policies require all agents to be granted"))
+
+			grant.Agents = []string{"*"}
+			Expect(grant.ValidateClient(client)).To(Succeed())
+		})
+
+		It("Should check organization units", func() {
+			client.OrganizationUnit = "other"
+			Expect(grant.ValidateClient(client)).To(MatchError("organization unit other is not granted"))
+
+			grant.OrganizationUnits = []string{"*"}
+			Expect(grant.ValidateClient(client)).To(Succeed())
+		})
+
+		It("Should check subjects", func() {
+			client.AdditionalPublishSubjects = []string{"custom"}
+			Expect(grant.ValidateClient(client)).To(MatchError("subject custom is not granted"))
+
+			client.AdditionalPublishSubjects = nil
+			client.AdditionalSubscribeSubjects = []string{"other.>"}
+			Expect(grant.ValidateClient(client)).To(MatchError("subject other.> is not granted"))
+		})
+
+		It("Should check caller ids", func() {
+			client.CallerID = "okta=bob"
+			Expect(grant.ValidateClient(client)).To(MatchError("caller id okta=bob is not granted"))
+
+			grant.CallerIDs = []string{"spiffe=*", "okta=*"}
+			Expect(grant.ValidateClient(client)).To(Succeed())
+
+			grant.CallerIDs = []string{"["}
+			Expect(grant.ValidateClient(client)).To(MatchError("caller id okta=bob is not granted"))
+
+			client.CallerID = "okta=acme/bob"
+			grant.CallerIDs = []string{"okta=*"}
+			Expect(grant.ValidateClient(client)).To(Succeed())
+			grant.CallerIDs = []string{"okta=acme/?ob"}
+			Expect(grant.ValidateClient(client)).To(Succeed())
+			grant.CallerIDs = []string{"okta=*/alice"}
+			Expect(grant.ValidateClient(client)).To(MatchError("caller id okta=acme/bob is not granted"))
+			client.CallerID = "okta=bob"
+
+			grant.CallerIDs = nil
+			Expect(grant.ValidateClient(client)).To(MatchError("caller id okta=bob is not granted"))
+		})
+	})
+
+	Describe("ValidateServer", func() {
+		It("Should accept servers within the grant", func() {
+			Expect(grant.ValidateServer(server)).To(Succeed())
+		})
+
+		It("Should check the server", func() {
+			server.ChoriaIdentity = "example.com"
+			Expect(grant.ValidateServer(server)).To(MatchError("identity example.com is not granted"))
+			grant.Identities = []string{"*.dc1.example.net", "*.com"}
+			Expect(grant.ValidateServer(server)).To(Succeed())
+			server.ChoriaIdentity = "web.dc2.example.net"
+			Expect(grant.ValidateServer(server)).To(MatchError("identity web.dc2.example.net is not granted"))
+			server.ChoriaIdentity = "web.dc1.example.net"
+
+			server.Permissions.Streams = true
+			Expect(grant.ValidateServer(server)).To(MatchError("permission streams is not granted"))
+			server.Permissions.Streams = false
+
+			server.OrganizationUnit = "other"
+			Expect(grant.ValidateServer(server)).To(MatchError("organization unit other is not granted"))
+			server.OrganizationUnit = "choria"
+
+			server.AdditionalPublishSubjects = []string{"choria.>"}
+			Expect(grant.ValidateServer(server)).To(MatchError("subject choria.> is not granted"))
+		})
+	})
+
+	Describe("ValidateProvisioning", func() {
+		It("Should check the provisioning token", func() {
+			prov, err := NewProvisioningClaims(true, true, "x", "", "", []string{"nats://example.net:4222"}, "", "", "", "", "", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(grant.ValidateProvisioning(prov)).To(MatchError("provisioning tokens are not granted"))
+
+			grant.Provisioning = true
+			Expect(grant.ValidateProvisioning(prov)).To(Succeed())
+
+			prov.OrganizationUnit = "other"
+			Expect(grant.ValidateProvisioning(prov)).To(MatchError("organization unit other is not granted"))
+		})
+	})
+
+	Describe("subjectIsSubset", func() {
+		It("Should follow NATS wildcard rules", func() {
+			Expect(subjectIsSubset(">", "a")).To(BeTrue())
+			Expect(subjectIsSubset(">", "a.>")).To(BeTrue())
+			Expect(subjectIsSubset("a.>", "a")).To(BeFalse())
+			Expect(subjectIsSubset("a.>", "a.b.c")).To(BeTrue())
+			Expect(subjectIsSubset("a.>", "a.*")).To(BeTrue())
+			Expect(subjectIsSubset("a.*", "a.b")).To(BeTrue())
+			Expect(subjectIsSubset("a.*", "a.*")).To(BeTrue())
+			Expect(subjectIsSubset("a.*", "a.>")).To(BeFalse())
+			Expect(subjectIsSubset("a.*", "a.b.c")).To(BeFalse())
+			Expect(subjectIsSubset("a.b", "a.*")).To(BeFalse())
+			Expect(subjectIsSubset("a.b", "a.b")).To(BeTrue())
+			Expect(subjectIsSubset("a.b", "a.c")).To(BeFalse())
+		})
+	})
+
+	Describe("matchPattern", func() {
+		It("Should match wildcards across any character", func() {
+			Expect(matchPattern("*", "")).To(BeTrue())
+			Expect(matchPattern("*", "a/b")).To(BeTrue())
+			Expect(matchPattern("okta=*", "okta=org/user")).To(BeTrue())
+			Expect(matchPattern("*.example.net", "n1.dc1.example.net")).To(BeTrue())
+			Expect(matchPattern("*.example.net", "example.net")).To(BeFalse())
+			Expect(matchPattern("a*b*c", "a/xb/yc")).To(BeTrue())
+			Expect(matchPattern("a*b*c", "a/xb/y")).To(BeFalse())
+			Expect(matchPattern("n?.example.net", "n1.example.net")).To(BeTrue())
+			Expect(matchPattern("n?.example.net", "n10.example.net")).To(BeFalse())
+			Expect(matchPattern("[a]", "a")).To(BeFalse())
+			Expect(matchPattern("[a]", "[a]")).To(BeTrue())
+		})
+	})
+
+	Describe("Chain issued tokens", func() {
+		var (
+			orgPubK     ed25519.PublicKey
+			orgPriK     ed25519.PrivateKey
+			handler     *ClientIDClaims
+			handlerPriK ed25519.PrivateKey
+		)
+
+		BeforeEach(func() {
+			orgPubK, orgPriK, err = iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+
+			var handlerPubK ed25519.PublicKey
+			handlerPubK, handlerPriK, err = iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+
+			handler, err = NewClientIDClaims("choria=handler", nil, "", nil, "", "", time.Hour, nil, handlerPubK)
+			Expect(err).ToNot(HaveOccurred())
+			handler.ChainGrant = grant
+			Expect(handler.AddOrgIssuerData(mustSigner(orgPriK))).To(Succeed())
+
+			userPubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			client.PublicKey = hex.EncodeToString(userPubK)
+		})
+
+		It("Should bind the grant to the chain issuer", func() {
+			Expect(handler.IsChainedIssuer(true)).To(BeTrue())
+
+			handler.ChainGrant = &ChainGrant{Agents: []string{"*"}}
+			Expect(handler.IsChainedIssuer(true)).To(BeFalse())
+		})
+
+		It("Should accept clients within the grant", func() {
+			Expect(client.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+			Expect(client.IssuerGrant).To(Equal(grant))
+
+			t, err := SignToken(client, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseClientIDToken(t, orgPubK, true)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should reject clients exceeding the grant", func() {
+			client.Permissions.OrgAdmin = true
+			Expect(client.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+
+			t, err := SignToken(client, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseClientIDToken(t, orgPubK, true)
+			Expect(err).To(MatchError("could not parse client id token: permission org_admin is not granted by chain issuer " + handler.ID))
+			Expect(errors.Is(err, ErrExceedsGrant)).To(BeTrue())
+
+			v, err := NewVerifier(WithTrustedKeys(orgPubK))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = v.VerifyClient(t)
+			Expect(errors.Is(err, ErrExceedsGrant)).To(BeTrue())
+		})
+
+		It("Should reject clients that alter the grant", func() {
+			client.Permissions.OrgAdmin = true
+			Expect(client.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+			client.IssuerGrant = nil
+
+			t, err := SignToken(client, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseClientIDToken(t, orgPubK, true)
+			Expect(err).To(MatchError("could not parse client id token: not signed by issuer: invalid org issuer signature for chain issuer " + handler.ID))
+		})
+
+		It("Should enforce grants of every chain issuer", func() {
+			delegate, err := NewClientIDClaims("choria=delegate", nil, "", nil, "", "", time.Hour, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			delegatePubK, delegatePriK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			delegate.PublicKey = hex.EncodeToString(delegatePubK)
+			delegate.ChainGrant = &ChainGrant{CallerIDs: []string{"*"}, Agents: []string{"*"}, OrganizationUnits: []string{"*"}, Permissions: &ClientPermissions{OrgAdmin: true, FleetManagement: true}}
+			Expect(delegate.AddChainDelegateData(handler, mustSigner(handlerPriK))).To(Succeed())
+
+			client.Permissions.OrgAdmin = true
+			Expect(client.AddChainIssuerData(delegate, mustSigner(delegatePriK))).To(Succeed())
+			Expect(client.IssuerChain[0].Grant).To(Equal(grant))
+
+			t, err := SignToken(client, mustSigner(delegatePriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseClientIDToken(t, orgPubK, true)
+			Expect(err).To(MatchError("could not parse client id token: permission org_admin is not granted by chain issuer " + handler.ID))
+
+			client.Permissions.OrgAdmin = false
+			Expect(client.AddChainIssuerData(delegate, mustSigner(delegatePriK))).To(Succeed())
+			t, err = SignToken(client, mustSigner(delegatePriK))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = ParseClientIDToken(t, orgPubK, true)
+			Expect(err).ToNot(HaveOccurred())
+
+			// altering the grant of the delegate breaks the chain
+			client.IssuerGrant.Permissions.StreamsAdmin = true
+			t, err = SignToken(client, mustSigner(delegatePriK))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = ParseClientIDToken(t, orgPubK, true)
+			Expect(err).To(MatchError("could not parse client id token: not signed by issuer: invalid chain signature for chain issuer " + delegate.ID))
+		})
+
+		It("Should reject caller ids and identities outside the grant", func() {
+			client.CallerID = "okta=bob"
+			Expect(client.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+			t, err := SignToken(client, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseClientIDToken(t, orgPubK, true)
+			Expect(err).To(MatchError("could not parse client id token: caller id okta=bob is not granted by chain issuer " + handler.ID))
+			Expect(errors.Is(err, ErrExceedsGrant)).To(BeTrue())
+
+			server.ChoriaIdentity = "example.com"
+			Expect(server.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+			t, err = SignToken(server, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseServerToken(t, orgPubK)
+			Expect(err).To(MatchError("could not parse server id token: identity example.com is not granted by chain issuer " + handler.ID))
+			Expect(errors.Is(err, ErrExceedsGrant)).To(BeTrue())
+		})
+
+		It("Should reject servers exceeding the grant", func() {
+			server.Permissions.ServiceHost = true
+			Expect(server.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+
+			t, err := SignToken(server, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseServerToken(t, orgPubK)
+			Expect(err).To(MatchError("could not parse server id token: permission service_host is not granted by chain issuer " + handler.ID))
+			Expect(errors.Is(err, ErrExceedsGrant)).To(BeTrue())
+
+			server.Permissions.ServiceHost = false
+			Expect(server.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+			t, err = SignToken(server, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseServerToken(t, orgPubK)
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,275 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+// JWK is a JSON Web Key as described in RFC 7517 holding a RSA, ECDSA or ed25519 public key
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set as described in RFC 7517
+type JWKS struct {
+	Keys []*JWK `json:"keys"`
+}
+
+// NewJWK creates a JWK for a public key, when kid is empty the PublicKeyID will be used
+func NewJWK(key crypto.PublicKey, kid string) (*JWK, error) {
+	jwk, err := newJWK(key)
+	if err != nil {
+		return nil, err
+	}
+
+	jwk.KeyID = kid
+	if jwk.KeyID == "" {
+		jwk.KeyID, err = jwk.Thumbprint()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return jwk, nil
+}
+
+func newJWK(key crypto.PublicKey) (*JWK, error) {
+	var jwk *JWK
+
+	switch pk := key.(type) {
+	case *rsa.PublicKey:
+		jwk = &JWK{
+			KeyType: "RSA",
+			N:       base64.RawURLEncoding.EncodeToString(pk.N.Bytes()),
+			E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pk.E)).Bytes()),
+		}
+
+	case *ecdsa.PublicKey:
+		method, err := ecdsaSigningMethod(pk.Curve)
+		if err != nil {
+			return nil, err
+		}
+		size := (pk.Curve.Params().BitSize + 7) / 8
+		jwk = &JWK{
+			KeyType:   "EC",
+			Algorithm: method.Alg(),
+			Curve:     pk.Curve.Params().Name,
+			X:         base64.RawURLEncoding.EncodeToString(pk.X.FillBytes(make([]byte, size))),
+			Y:         base64.RawURLEncoding.EncodeToString(pk.Y.FillBytes(make([]byte, size))),
+		}
+
+	case ed25519.PublicKey:
+		if len(pk) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 public key size")
+		}
+		jwk = &JWK{
+			KeyType:   "OKP",
+			Algorithm: algEdDSA,
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(pk),
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+
+	jwk.Use = "sig"
+
+	return jwk, nil
+}
+
+// Thumbprint calculates the RFC 7638 thumbprint of the key
+func (j *JWK) Thumbprint() (string, error) {
+	var tp string
+
+	switch j.KeyType {
+	case "RSA":
+		tp = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, j.E, j.N)
+	case "EC":
+		tp = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, j.Curve, j.X, j.Y)
+	case "OKP":
+		tp = fmt.Sprintf(`{"crv":"%s","kty":"OKP","x":"%s"}`, j.Curve, j.X)
+	default:
+		return "", fmt.Errorf("unsupported key type %q", j.KeyType)
+	}
+
+	sum := sha256.Sum256([]byte(tp))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// PublicKey decodes the public key held in the JWK
+func (j *JWK) PublicKey() (crypto.PublicKey, error) {
+	switch j.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(j.N)
+		if err != nil || len(n) == 0 {
+			return nil, fmt.Errorf("invalid rsa modulus in key %s", j.KeyID)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(j.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid rsa exponent in key %s", j.KeyID)
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported ecdsa curve %s in key %s", j.Curve, j.KeyID)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate in key %s", j.KeyID)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(j.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate in key %s", j.KeyID)
+		}
+
+		pk := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pk.X, pk.Y) {
+			return nil, fmt.Errorf("invalid ecdsa point in key %s", j.KeyID)
+		}
+
+		return pk, nil
+
+	case "OKP":
+		if j.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s in key %s", j.Curve, j.KeyID)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 public key in key %s", j.KeyID)
+		}
+
+		return ed25519.PublicKey(x), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", j.KeyType)
+	}
+}
+
+// JWKSFromPublicKeys renders public keys as a JSON Web Key Set using PublicKeyID for the key ids
+func JWKSFromPublicKeys(keys ...crypto.PublicKey) ([]byte, error) {
+	set := &JWKS{Keys: []*JWK{}}
+
+	for _, key := range keys {
+		jwk, err := NewJWK(key, "")
+		if err != nil {
+			return nil, err
+		}
+
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	return json.MarshalIndent(set, "", "  ")
+}
+
+// JWKS renders all the keys in the keyring as a JSON Web Key Set
+func (k *Keyring) JWKS() ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := &JWKS{Keys: []*JWK{}}
+
+	for _, e := range k.keys {
+		jwk, err := NewJWK(e.key, e.kid)
+		if err != nil {
+			return nil, err
+		}
+
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	return json.MarshalIndent(set, "", "  ")
+}
+
+// AddJWKS adds all the signing keys found in a JSON Web Key Set document to the keyring.
+//
+// Keys with a use other than sig and keys of types other than RSA, EC and OKP are skipped
+func (k *Keyring) AddJWKS(dat []byte) error {
+	set := &JWKS{}
+	err := json.Unmarshal(dat, set)
+	if err != nil {
+		return fmt.Errorf("invalid JWKS document: %w", err)
+	}
+
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		switch jwk.KeyType {
+		case "RSA", "EC", "OKP":
+		default:
+			continue
+		}
+
+		pk, err := jwk.PublicKey()
+		if err != nil {
+			return err
+		}
+
+		if jwk.KeyID == "" {
+			err = k.Add(pk)
+		} else {
+			err = k.AddWithKeyID(jwk.KeyID, pk)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddJWKSFile adds all the signing keys found in a JSON Web Key Set file to the keyring
+func (k *Keyring) AddJWKSFile(file string) error {
+	dat, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	return k.AddJWKS(dat)
+}
+
+// NewKeyringFromJWKS creates a Keyring holding the signing keys found in a JSON Web Key Set document
+func NewKeyringFromJWKS(dat []byte) (*Keyring, error) {
+	k := &Keyring{}
+
+	err := k.AddJWKS(dat)
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/gjson"
+)
+
+var _ = Describe("JWKS", func() {
+	Describe("JWKSFromPublicKeys", func() {
+		It("Should render all supported keys", func() {
+			edPubK, _ := loadEd25519Seed("testdata/ed25519/signer.seed")
+
+			dat, err := JWKSFromPublicKeys(loadRSAPubKey("testdata/rsa/signer-public.pem"), loadECDSAPubKey("testdata/ecdsa/signer-public.pem"), edPubK)
+			Expect(err).ToNot(HaveOccurred())
+
+			keys := gjson.GetBytes(dat, "keys").Array()
+			Expect(keys).To(HaveLen(3))
+			Expect(keys[0].Get("kty").String()).To(Equal("RSA"))
+			Expect(keys[0].Get("e").String()).To(Equal("AQAB"))
+			Expect(keys[1].Get("kty").String()).To(Equal("EC"))
+			Expect(keys[1].Get("crv").String()).To(Equal("P-256"))
+			Expect(keys[1].Get("alg").String()).To(Equal("ES256"))
+			Expect(keys[2].Get("kty").String()).To(Equal("OKP"))
+			Expect(keys[2].Get("crv").String()).To(Equal("Ed25519"))
+
+			kid, err := PublicKeyID(edPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(keys[2].Get("kid").String()).To(Equal(kid))
+
+			_, err = JWKSFromPublicKeys("x")
+			Expect(err).To(MatchError("unsupported public key type string"))
+		})
+	})
+
+	Describe("AddJWKS", func() {
+		It("Should round trip keys", func() {
+			edPubK, _ := loadEd25519Seed("testdata/ed25519/signer.seed")
+			kr, err := NewKeyring(loadRSAPubKey("testdata/rsa/signer-public.pem"), loadECDSAPubKey("testdata/ecdsa/p384-public.pem"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(kr.AddWithKeyID("org", edPubK)).To(Succeed())
+
+			dat, err := kr.JWKS()
+			Expect(err).ToNot(HaveOccurred())
+
+			kr2, err := NewKeyringFromJWKS(dat)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(kr2.KeyIDs()).To(Equal(kr.KeyIDs()))
+
+			for _, kid := range kr.KeyIDs() {
+				k1, _ := kr.Key(kid)
+				k2, _ := kr2.Key(kid)
+				Expect(k2).To(Equal(k1))
+			}
+		})
+
+		It("Should skip unsupported keys and fail on invalid ones", func() {
+			kr, err := NewKeyringFromJWKS([]byte(`{"keys":[{"kty":"oct","k":"x"},{"kty":"RSA","use":"enc","n":"x","e":"AQAB"}]}`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(kr.Len()).To(Equal(0))
+
+			_, err = NewKeyringFromJWKS([]byte(`{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"x","x":"AA"}]}`))
+			Expect(err).To(MatchError("invalid ed25519 public key in key x"))
+
+			_, err = NewKeyringFromJWKS([]byte(`{"keys":[{"kty":"EC","crv":"P-256","kid":"x","x":"AA","y":"AA"}]}`))
+			Expect(err).To(MatchError("invalid ecdsa point in key x"))
+		})
+
+		It("Should verify tokens using keys from a file", func() {
+			dat, err := JWKSFromPublicKeys(loadRSAPubKey("testdata/rsa/signer-public.pem"))
+			Expect(err).ToNot(HaveOccurred())
+
+			jwks := filepath.Join(GinkgoT().TempDir(), "jwks.json")
+			Expect(os.WriteFile(jwks, dat, 0600)).To(Succeed())
+
+			kr := &Keyring{}
+			Expect(kr.AddJWKSFile(jwks)).To(Succeed())
+
+			claims, err := newStandardClaims("ginkgo", ProvisioningPurpose, 0, false)
+			Expect(err).ToNot(HaveOccurred())
+			t, err := SignTokenWithKeyFile(claims, "testdata/rsa/signer-key.pem")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(ParseToken(t, &StandardClaims{}, kr)).To(Succeed())
+		})
+	})
+})
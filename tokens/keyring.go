@@ -0,0 +1,233 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Keyring is a set of public keys that tokens can be verified against, it can be passed to ParseToken and
+// related functions in place of a single public key.
+//
+// Keys are selected using the kid header of a token, when no key matches the kid every key suitable for the
+// algorithm of the token is tried in turn.
+type Keyring struct {
+	keys    []*keyringEntry
+	version uint64
+	mu      sync.RWMutex
+}
+
+type keyringEntry struct {
+	kid string
+	key crypto.PublicKey
+}
+
+// NewKeyring creates a new Keyring holding keys, key ids are calculated using PublicKeyID
+func NewKeyring(keys ...crypto.PublicKey) (*Keyring, error) {
+	k := &Keyring{}
+
+	for _, key := range keys {
+		err := k.Add(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return k, nil
+}
+
+// Add adds key to the keyring using the key id calculated by PublicKeyID
+func (k *Keyring) Add(key crypto.PublicKey) error {
+	kid, err := PublicKeyID(key)
+	if err != nil {
+		return err
+	}
+
+	return k.AddWithKeyID(kid, key)
+}
+
+// AddWithKeyID adds key to the keyring with a specific key id
+func (k *Keyring) AddWithKeyID(kid string, key crypto.PublicKey) error {
+	if kid == "" {
+		return fmt.Errorf("key id is required")
+	}
+
+	_, err := PublicKeyID(key)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.version = nextTrustVersion()
+
+	for _, e := range k.keys {
+		if e.kid == kid {
+			e.key = key
+			return nil
+		}
+	}
+
+	k.keys = append(k.keys, &keyringEntry{kid: kid, key: key})
+
+	return nil
+}
+
+// AddFile adds a RSA, ECDSA or ed25519 public key stored in file
+func (k *Keyring) AddFile(file string) error {
+	dat, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("could not read validation certificate: %s", err)
+	}
+
+	pk, err := readPublicKeyData(dat)
+	if err != nil {
+		return err
+	}
+
+	return k.Add(pk)
+}
+
+// Len is the number of keys in the keyring
+func (k *Keyring) Len() int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return len(k.keys)
+}
+
+// KeyIDs are the ids of all keys in the keyring
+func (k *Keyring) KeyIDs() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	var ids []string
+	for _, e := range k.keys {
+		ids = append(ids, e.kid)
+	}
+
+	return ids
+}
+
+// Key finds a key by id
+func (k *Keyring) Key(kid string) (crypto.PublicKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, e := range k.keys {
+		if e.kid == kid {
+			return e.key, true
+		}
+	}
+
+	return nil, false
+}
+
+// trustVersion changes whenever keys are added to or replaced in the keyring
+func (k *Keyring) trustVersion() uint64 {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.version
+}
+
+// candidates finds the keys that should be tried to verify a token signed using alg with the given kid
+func (k *Keyring) candidates(kid string, alg string) []crypto.PublicKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	var matched, suitable []crypto.PublicKey
+
+	for _, e := range k.keys {
+		if !isKeySuitableForAlgorithm(e.key, alg) {
+			continue
+		}
+
+		if kid != "" && e.kid == kid {
+			matched = append(matched, e.key)
+		}
+
+		suitable = append(suitable, e.key)
+	}
+
+	if len(matched) > 0 {
+		return matched
+	}
+
+	return suitable
+}
+
+// parseTokenWithKeyring tries the suitable keys in the keyring in turn until one validates the token signature
+func parseTokenWithKeyring(d *decodedToken, k *Keyring, opts *parseOpts) error {
+	t := d.token
+
+	kid, _ := t.Header["kid"].(string)
+	keys := k.candidates(kid, t.Method.Alg())
+	if len(keys) == 0 {
+		return fmt.Errorf("no suitable %s key found in keyring", t.Method.Alg())
+	}
+
+	var err error
+	for _, key := range keys {
+		err = parseTokenWithKey(d, key, opts)
+		if err == nil {
+			return nil
+		}
+
+		// only a signature made by another key moves on to the next key, any other failure like a revoked
+		// chain issuer or invalid claims is final so that it is not masked by the signature errors of later keys
+		if !errors.Is(err, jwt.ErrTokenSignatureInvalid) && !errors.Is(err, ErrChainSignatureInvalid) {
+			return err
+		}
+	}
+
+	return err
+}
+
+func isKeySuitableForAlgorithm(key crypto.PublicKey, alg string) bool {
+	switch alg {
+	case algRS256, algRS384, algRS512, algPS256, algPS384, algPS512:
+		_, ok := key.(*rsa.PublicKey)
+		return ok
+
+	case algEdDSA:
+		_, ok := key.(ed25519.PublicKey)
+		return ok
+
+	case algES256, algES384:
+		pk, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+		method, err := ecdsaSigningMethod(pk.Curve)
+		if err != nil {
+			return false
+		}
+		return method.Alg() == alg
+
+	default:
+		return false
+	}
+}
+
+// PublicKeyID calculates the RFC 7638 JWK thumbprint of a RSA, ECDSA or ed25519 public key for use as a key id
+func PublicKeyID(key crypto.PublicKey) (string, error) {
+	jwk, err := newJWK(key)
+	if err != nil {
+		return "", err
+	}
+
+	return jwk.Thumbprint()
+}
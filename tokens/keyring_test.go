@@ -0,0 +1,178 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"time"
+
+	iu "github.com/choria-io/go-choria/internal/util"
+	"github.com/golang-jwt/jwt/v4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Keyring", func() {
+	Describe("PublicKeyID", func() {
+		It("Should calculate RFC 7638 thumbprints", func() {
+			// from RFC 8037 Appendix A.3
+			pk := []byte{0xd7, 0x5a, 0x98, 0x01, 0x82, 0xb1, 0x0a, 0xb7, 0xd5, 0x4b, 0xfe, 0xd3, 0xc9, 0x64, 0x07, 0x3a, 0x0e, 0xe1, 0x72, 0xf3, 0xda, 0xa6, 0x23, 0x25, 0xaf, 0x02, 0x1a, 0x68, 0xf7, 0x07, 0x51, 0x1a}
+			kid, err := PublicKeyID(ed25519.PublicKey(pk))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(kid).To(Equal("kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k"))
+
+			_, err = PublicKeyID("x")
+			Expect(err).To(MatchError("unsupported public key type string"))
+		})
+	})
+
+	Describe("Add", func() {
+		It("Should add and replace keys", func() {
+			kr, err := NewKeyring(loadRSAPubKey("testdata/rsa/signer-public.pem"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(kr.Len()).To(Equal(1))
+
+			Expect(kr.AddFile("testdata/ecdsa/signer-public.pem")).To(Succeed())
+			Expect(kr.AddFile("testdata/ed25519/signer.public")).To(Succeed())
+			Expect(kr.Len()).To(Equal(3))
+
+			Expect(kr.AddWithKeyID("rotated", loadRSAPubKey("testdata/rsa/other-public.pem"))).To(Succeed())
+			Expect(kr.AddWithKeyID("rotated", loadRSAPubKey("testdata/rsa/signer-public.pem"))).To(Succeed())
+			Expect(kr.Len()).To(Equal(4))
+
+			pk, ok := kr.Key("rotated")
+			Expect(ok).To(BeTrue())
+			Expect(pk).To(Equal(loadRSAPubKey("testdata/rsa/signer-public.pem")))
+
+			Expect(kr.Add("x")).To(MatchError("unsupported public key type string"))
+		})
+	})
+
+	Describe("ParseToken", func() {
+		var kr *Keyring
+
+		BeforeEach(func() {
+			var err error
+			kr, err = NewKeyring(loadRSAPubKey("testdata/rsa/other-public.pem"), loadRSAPubKey("testdata/rsa/signer-public.pem"))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should set the kid header", func() {
+			claims, err := newStandardClaims("ginkgo", ProvisioningPurpose, 0, false)
+			Expect(err).ToNot(HaveOccurred())
+
+			t, err := SignTokenWithKeyFile(claims, "testdata/rsa/signer-key.pem", WithSignerKeyID("ginkgo"))
+			Expect(err).ToNot(HaveOccurred())
+
+			token, _, err := new(jwt.Parser).ParseUnverified(t, &StandardClaims{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(token.Header["kid"]).To(Equal("ginkgo"))
+		})
+
+		It("Should select keys by kid", func() {
+			claims, err := newStandardClaims("ginkgo", ProvisioningPurpose, 0, false)
+			Expect(err).ToNot(HaveOccurred())
+
+			t, err := SignTokenWithKeyFile(claims, "testdata/rsa/signer-key.pem")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(kr.candidates(mustSigner(loadRSAPriKey("testdata/rsa/signer-key.pem")).KeyID(), "RS256")).To(HaveLen(1))
+			Expect(ParseToken(t, &StandardClaims{}, kr)).To(Succeed())
+		})
+
+		It("Should try all suitable keys without a matching kid", func() {
+			claims, err := newStandardClaims("ginkgo", ProvisioningPurpose, 0, false)
+			Expect(err).ToNot(HaveOccurred())
+
+			t, err := SignTokenWithKeyFile(claims, "testdata/rsa/signer-key.pem", WithSignerKeyID("unknown"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ParseToken(t, &StandardClaims{}, kr)).To(Succeed())
+
+			t, err = SignTokenWithKeyFile(claims, "testdata/ed25519/signer.seed")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ParseToken(t, &StandardClaims{}, kr)).To(MatchError("no suitable EdDSA key found in keyring"))
+
+			kr, err = NewKeyring(loadRSAPubKey("testdata/rsa/other-public.pem"))
+			Expect(err).ToNot(HaveOccurred())
+			t, err = SignTokenWithKeyFile(claims, "testdata/rsa/signer-key.pem")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ParseToken(t, &StandardClaims{}, kr)).To(MatchError("crypto/rsa: verification error"))
+		})
+
+		It("Should not retry after signature validation", func() {
+			claims, err := NewClientIDClaims("up=ginkgo", nil, "", nil, "", "", time.Hour, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+
+			t, err := SignTokenWithKeyFile(claims, "testdata/rsa/signer-key.pem")
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseClientIDToken(t, kr, true)
+			Expect(err).To(MatchError(jwt.ErrTokenExpired))
+		})
+
+		It("Should verify chains against all org issuers", func() {
+			otherPubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			issuerPubK, issuerPriK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			handlerPubK, handlerPriK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+
+			handler, err := NewClientIDClaims("choria=handler", nil, "", nil, "", "", time.Hour, nil, handlerPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(handler.AddOrgIssuerData(mustSigner(issuerPriK))).To(Succeed())
+
+			userPubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+
+			user, err := NewClientIDClaims("choria=user", nil, "", nil, "", "", time.Hour, nil, userPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(user.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+			t, err := SignToken(user, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			kr, err = NewKeyring(otherPubK, issuerPubK)
+			Expect(err).ToNot(HaveOccurred())
+
+			parsed, err := ParseClientIDToken(t, kr, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed.CallerID).To(Equal("choria=user"))
+		})
+
+		It("Should not retry after failures other than signature mismatches", func() {
+			otherPubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			issuerPubK, issuerPriK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			handlerPubK, handlerPriK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+
+			handler, err := NewClientIDClaims("choria=handler", nil, "", nil, "", "", time.Hour, nil, handlerPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(handler.AddOrgIssuerData(mustSigner(issuerPriK))).To(Succeed())
+
+			userPubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+
+			user, err := NewClientIDClaims("choria=user", nil, "", nil, "", "", time.Hour, nil, userPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(user.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+			t, err := SignToken(user, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			list, err := NewRevocationListClaims("ginkgo", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(list.RevokeChainIssuer(handler.ID)).To(Succeed())
+
+			kr, err = NewKeyring(issuerPubK, otherPubK)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseClientIDToken(t, kr, true, WithRevocations(list))
+			Expect(errors.Is(err, ErrRevoked)).To(BeTrue())
+		})
+	})
+})
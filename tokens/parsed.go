@@ -0,0 +1,253 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// decodedToken is a JWT with its header and claims segments decoded, the signature is not yet verified
+type decodedToken struct {
+	token         *jwt.Token
+	signingString string
+	claimsData    []byte
+}
+
+// decodeToken decodes the header and claims segments of token, errors match those of the jwt parser
+func decodeToken(token string) (*decodedToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, jwt.NewValidationError("token contains an invalid number of segments", jwt.ValidationErrorMalformed)
+	}
+
+	t := &jwt.Token{Raw: token, Signature: parts[2]}
+
+	headerData, err := jwt.DecodeSegment(parts[0])
+	if err != nil {
+		if strings.HasPrefix(strings.ToLower(token), "bearer ") {
+			return nil, jwt.NewValidationError("tokenstring should not contain 'bearer '", jwt.ValidationErrorMalformed)
+		}
+		return nil, &jwt.ValidationError{Inner: err, Errors: jwt.ValidationErrorMalformed}
+	}
+
+	err = json.Unmarshal(headerData, &t.Header)
+	if err != nil {
+		return nil, &jwt.ValidationError{Inner: err, Errors: jwt.ValidationErrorMalformed}
+	}
+
+	claimsData, err := jwt.DecodeSegment(parts[1])
+	if err != nil {
+		return nil, &jwt.ValidationError{Inner: err, Errors: jwt.ValidationErrorMalformed}
+	}
+
+	alg, ok := t.Header["alg"].(string)
+	if !ok {
+		return nil, jwt.NewValidationError("signing method (alg) is unspecified.", jwt.ValidationErrorUnverifiable)
+	}
+
+	t.Method = jwt.GetSigningMethod(alg)
+	if t.Method == nil {
+		return nil, jwt.NewValidationError("signing method (alg) is unavailable.", jwt.ValidationErrorUnverifiable)
+	}
+
+	return &decodedToken{
+		token:         t,
+		signingString: token[:len(parts[0])+len(parts[1])+1],
+		claimsData:    claimsData,
+	}, nil
+}
+
+// decodeClaims decodes the claims segment into claims
+func (d *decodedToken) decodeClaims(claims jwt.Claims) error {
+	var err error
+
+	dec := json.NewDecoder(bytes.NewReader(d.claimsData))
+	if c, ok := claims.(jwt.MapClaims); ok {
+		err = dec.Decode(&c)
+	} else {
+		err = dec.Decode(&claims)
+	}
+	if err != nil {
+		return &jwt.ValidationError{Inner: err, Errors: jwt.ValidationErrorMalformed}
+	}
+
+	d.token.Claims = claims
+
+	return nil
+}
+
+// verify verifies the signature using the key returned by keyFunc and validates the claims, like jwt.Parser would
+func (d *decodedToken) verify(opts *parseOpts, keyFunc jwt.Keyfunc) error {
+	t := d.token
+
+	if opts.methods != nil && !stringInList(opts.methods, t.Method.Alg()) {
+		return jwt.NewValidationError(fmt.Sprintf("signing method %v is invalid", t.Method.Alg()), jwt.ValidationErrorSignatureInvalid)
+	}
+
+	key, err := keyFunc(t)
+	if err != nil {
+		if ve, ok := err.(*jwt.ValidationError); ok {
+			return ve
+		}
+		return &jwt.ValidationError{Inner: err, Errors: jwt.ValidationErrorUnverifiable}
+	}
+
+	err = t.Method.Verify(d.signingString, t.Signature, key)
+	if err != nil {
+		return &jwt.ValidationError{Inner: err, Errors: jwt.ValidationErrorSignatureInvalid}
+	}
+
+	return d.validateClaims(opts)
+}
+
+// validateClaims validates the claims of a token with a verified signature, unless disabled in opts
+func (d *decodedToken) validateClaims(opts *parseOpts) error {
+	t := d.token
+
+	if !opts.skipValidation {
+		err := t.Claims.Valid()
+		if err != nil {
+			if ve, ok := err.(*jwt.ValidationError); ok {
+				return ve
+			}
+			return &jwt.ValidationError{Inner: err, Errors: jwt.ValidationErrorClaimsInvalid}
+		}
+	}
+
+	t.Valid = true
+
+	return nil
+}
+
+// purpose determines the purpose of the token from the decoded claims, see TokenPurpose
+func (d *decodedToken) purpose() Purpose {
+	claims := struct {
+		Purpose Purpose `json:"purpose"`
+		Subject string  `json:"sub"`
+	}{}
+	json.Unmarshal(d.claimsData, &claims)
+
+	if claims.Purpose == UnknownPurpose && claims.Subject == string(ProvisioningPurpose) {
+		return ProvisioningPurpose
+	}
+
+	return claims.Purpose
+}
+
+// ParsedToken is a token that is decoded once and can then be inspected, checked for its purpose and verified
+// without parsing it again. Claims should not be trusted until Verify succeeded.
+//
+// A ParsedToken is not safe for concurrent use
+type ParsedToken struct {
+	d        *decodedToken
+	purpose  Purpose
+	claims   Claims
+	verified bool
+}
+
+// NewParsedToken decodes token into the claims registered for its purpose without verifying it,
+// tokens with purposes that are not registered are decoded into StandardClaims
+func NewParsedToken(token string) (*ParsedToken, error) {
+	d, err := decodeToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ParsedToken{d: d, purpose: d.purpose()}
+
+	if def := lookupPurpose(p.purpose); def != nil {
+		p.claims = def.New()
+	} else {
+		p.claims = &StandardClaims{}
+	}
+
+	err = d.decodeClaims(p.claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Raw is the token as it was parsed
+func (p *ParsedToken) Raw() string {
+	return p.d.token.Raw
+}
+
+// Purpose is the purpose of the token, see TokenPurpose
+func (p *ParsedToken) Purpose() Purpose {
+	return p.purpose
+}
+
+// Claims are the claims of the token, of the type registered for its purpose
+func (p *ParsedToken) Claims() Claims {
+	return p.claims
+}
+
+// StandardClaims are the standard claims of the token
+func (p *ParsedToken) StandardClaims() *StandardClaims {
+	return p.claims.standardClaims()
+}
+
+// IsVerified determines if Verify succeeded for this token
+func (p *ParsedToken) IsVerified() bool {
+	return p.verified
+}
+
+// ClientIDClaims are the claims of a client id token
+func (p *ParsedToken) ClientIDClaims() (*ClientIDClaims, error) {
+	claims, ok := p.claims.(*ClientIDClaims)
+	if !ok {
+		return nil, ErrNotAClientToken
+	}
+
+	return claims, nil
+}
+
+// ServerClaims are the claims of a server token
+func (p *ParsedToken) ServerClaims() (*ServerClaims, error) {
+	claims, ok := p.claims.(*ServerClaims)
+	if !ok {
+		return nil, ErrNotAServerToken
+	}
+
+	return claims, nil
+}
+
+// ProvisioningClaims are the claims of a provisioning token
+func (p *ParsedToken) ProvisioningClaims() (*ProvisioningClaims, error) {
+	claims, ok := p.claims.(*ProvisioningClaims)
+	if !ok {
+		return nil, ErrNotAProvisioningToken
+	}
+
+	return claims, nil
+}
+
+// Verify verifies the token using pk and opts, see ParseToken, and performs the checks registered for its purpose
+func (p *ParsedToken) Verify(pk any, opts ...ParseOption) error {
+	p.verified = false
+
+	err := verifyDecodedToken(p.d, pk, newParseOpts(opts))
+	if err != nil {
+		return fmt.Errorf("could not parse %s token: %w", p.purpose, err)
+	}
+
+	if def := lookupPurpose(p.purpose); def != nil && def.Verified != nil {
+		err = def.Verified(p.claims)
+		if err != nil {
+			return err
+		}
+	}
+
+	p.verified = true
+
+	return nil
+}
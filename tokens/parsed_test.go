@@ -0,0 +1,274 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	iu "github.com/choria-io/go-choria/internal/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParsedToken", func() {
+	var (
+		orgPubK ed25519.PublicKey
+		orgPriK ed25519.PrivateKey
+		err     error
+	)
+
+	sign := func(claims Claims) string {
+		t, err := SignToken(claims, mustSigner(orgPriK))
+		Expect(err).ToNot(HaveOccurred())
+		return t
+	}
+
+	BeforeEach(func() {
+		orgPubK, orgPriK, err = iu.Ed25519KeyPair()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Describe("NewParsedToken", func() {
+		It("Should reject malformed tokens", func() {
+			_, err := NewParsedToken("x.y")
+			Expect(err).To(MatchError("token contains an invalid number of segments"))
+
+			_, err = NewParsedToken("x.y.z")
+			Expect(err).To(MatchError(ContainSubstring("illegal base64 data")))
+		})
+
+		It("Should decode into the registered claims", func() {
+			client, err := NewClientIDClaims("up=ginkgo", nil, "", nil, "", "", time.Hour, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			p, err := NewParsedToken(sign(client))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p.Purpose()).To(Equal(ClientIDPurpose))
+			Expect(p.IsVerified()).To(BeFalse())
+			Expect(p.StandardClaims().ID).To(Equal(client.ID))
+
+			c, err := p.ClientIDClaims()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.CallerID).To(Equal("up=ginkgo"))
+
+			_, err = p.ServerClaims()
+			Expect(err).To(MatchError(ErrNotAServerToken))
+			_, err = p.ProvisioningClaims()
+			Expect(err).To(MatchError(ErrNotAProvisioningToken))
+		})
+
+		It("Should support legacy provisioning tokens", func() {
+			prov, err := NewProvisioningClaims(true, true, "x", "", "", []string{"nats://example.net:4222"}, "", "", "", "", "", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			prov.Purpose = UnknownPurpose
+
+			p, err := NewParsedToken(sign(prov))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p.Purpose()).To(Equal(ProvisioningPurpose))
+			_, err = p.ProvisioningClaims()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should decode unknown purposes into standard claims", func() {
+			std, err := newStandardClaims("", "other", time.Hour, false)
+			Expect(err).ToNot(HaveOccurred())
+
+			p, err := NewParsedToken(sign(std))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p.Claims()).To(BeAssignableToTypeOf(&StandardClaims{}))
+			Expect(p.Verify(orgPubK)).To(Succeed())
+		})
+	})
+
+	Describe("Verify", func() {
+		It("Should verify the token", func() {
+			server, err := NewServerClaims("n1.example.net", []string{"choria"}, "", nil, nil, orgPubK, "", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			t := sign(server)
+
+			p, err := NewParsedToken(t)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p.Raw()).To(Equal(t))
+
+			otherPubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p.Verify(otherPubK)).To(MatchError("could not parse choria_server token: ed25519: verification error"))
+			Expect(p.IsVerified()).To(BeFalse())
+
+			Expect(p.Verify(orgPubK)).To(Succeed())
+			Expect(p.IsVerified()).To(BeTrue())
+
+			kr, err := NewKeyring(otherPubK, orgPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p.Verify(kr)).To(Succeed())
+		})
+
+		It("Should detect tampering", func() {
+			client, err := NewClientIDClaims("up=ginkgo", nil, "", nil, "", "", time.Hour, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			t := sign(client)
+
+			client.CallerID = "up=admin"
+			forged := sign(client)
+			parts := strings.Split(forged, ".")
+			parts[2] = strings.Split(t, ".")[2]
+
+			p, err := NewParsedToken(strings.Join(parts, "."))
+			Expect(err).ToNot(HaveOccurred())
+			err = p.Verify(orgPubK)
+			Expect(err).To(HaveOccurred())
+			Expect(p.IsVerified()).To(BeFalse())
+		})
+
+		It("Should validate the standard claims", func() {
+			client, err := NewClientIDClaims("up=ginkgo", nil, "", nil, "", "", time.Hour, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			client.ExpiresAt.Time = time.Now().Add(-time.Minute)
+
+			p, err := NewParsedToken(sign(client))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p.Verify(orgPubK)).To(MatchError(ContainSubstring("token is expired")))
+		})
+
+		It("Should verify chain issued tokens and call the purpose hooks", func() {
+			issuerPubK, issuerPriK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			issuer, err := NewClientIDClaims("choria=issuer", nil, "", nil, "", "", time.Hour, nil, issuerPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(issuer.AddOrgIssuerData(mustSigner(orgPriK))).To(Succeed())
+
+			prov, err := NewProvisioningClaims(true, true, "x", "", "", []string{"nats://example.net:4222"}, "", "", "", "", "", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			prov.OrganizationUnit = ""
+			Expect(prov.AddChainIssuerData(issuer, mustSigner(issuerPriK))).To(Succeed())
+			t, err := SignToken(prov, mustSigner(issuerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			p, err := NewParsedToken(t)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p.Verify(orgPubK)).To(Succeed())
+
+			c, err := p.ProvisioningClaims()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.OrganizationUnit).To(Equal("choria"))
+
+			err = p.Verify(issuerPubK)
+			Expect(errors.Is(err, ErrChainSignatureInvalid)).To(BeTrue())
+		})
+	})
+})
+
+// benchmarkClientToken creates a client token issued by a chain issuer and the org issuer public key
+func benchmarkClientToken(b *testing.B) (string, ed25519.PublicKey) {
+	orgPubK, orgPriK, err := iu.Ed25519KeyPair()
+	if err != nil {
+		b.Fatal(err)
+	}
+	orgSigner, err := NewKeySigner(orgPriK)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	issuerPubK, issuerPriK, err := iu.Ed25519KeyPair()
+	if err != nil {
+		b.Fatal(err)
+	}
+	issuerSigner, err := NewKeySigner(issuerPriK)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	issuer, err := NewClientIDClaims("choria=aaa", nil, "", nil, "", "", time.Hour, nil, issuerPubK)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = issuer.AddOrgIssuerData(orgSigner)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	userPubK, _, err := iu.Ed25519KeyPair()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	user, err := NewClientIDClaims("up=bob", []string{"rpcutil", "puppet"}, "", map[string]string{"group": "admins"}, "", "", time.Hour, &ClientPermissions{StreamsUser: true}, userPubK)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = user.AddChainIssuerData(issuer, issuerSigner)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	token, err := SignToken(user, issuerSigner)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return token, orgPubK
+}
+
+// BenchmarkAuthenticateClientRepeatedParsing is the typical broker connection authentication using the per purpose functions
+func BenchmarkAuthenticateClientRepeatedParsing(b *testing.B) {
+	token, orgPubK := benchmarkClientToken(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if TokenPurpose(token) != ClientIDPurpose {
+			b.Fatal("not a client token")
+		}
+
+		ok, err := IsClientIDTokenString(token)
+		if err != nil || !ok {
+			b.Fatal("not a client token")
+		}
+
+		_, caller, err := UnverifiedCallerFromClientIDToken(token)
+		if err != nil || caller != "up=bob" {
+			b.Fatalf("invalid caller %q: %v", caller, err)
+		}
+
+		_, err = ParseClientIDToken(token, orgPubK, true)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkAuthenticateClientParsedToken is the same authentication as BenchmarkAuthenticateClientRepeatedParsing using a ParsedToken
+func BenchmarkAuthenticateClientParsedToken(b *testing.B) {
+	token, orgPubK := benchmarkClientToken(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		p, err := NewParsedToken(token)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if p.Purpose() != ClientIDPurpose {
+			b.Fatal("not a client token")
+		}
+
+		client, err := p.ClientIDClaims()
+		if err != nil || client.CallerID != "up=bob" {
+			b.Fatalf("invalid client: %v", err)
+		}
+
+		err = p.Verify(orgPubK)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	iu "github.com/choria-io/go-choria/internal/util"
+)
+
+// PossessionChallengeSize is the size of the nonce created by NewPossessionChallenge
+const PossessionChallengeSize = 32
+
+// possessionContext is prefixed to challenges before signing so that a challenge can not be used to obtain signatures over other data
+const possessionContext = "choria_proof_of_possession"
+
+// NewPossessionChallenge creates a random nonce that the holder of a token must sign to prove it holds the private key matching the token public key
+func NewPossessionChallenge() ([]byte, error) {
+	nonce := make([]byte, PossessionChallengeSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return nonce, nil
+}
+
+// SignPossessionChallenge signs challenge using the ed25519 signer holding the private key matching the token public key
+func SignPossessionChallenge(challenge []byte, signer Signer) ([]byte, error) {
+	_, err := signerEd25519PublicKey(signer)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(challenge) < PossessionChallengeSize {
+		return nil, fmt.Errorf("challenge is too short")
+	}
+
+	return signer.Sign(possessionData(challenge))
+}
+
+// SignPossessionChallengeWithSeedFile signs challenge using the ed25519 seed stored in file
+func SignPossessionChallengeWithSeedFile(challenge []byte, file string) ([]byte, error) {
+	signer, err := NewFileSigner(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return SignPossessionChallenge(challenge, signer)
+}
+
+// VerifyPossession verifies that sig is a signature of challenge made by the private key matching the public key
+// in the token, proving the party presenting the token holds its private key.
+//
+// The claims must be from a token that was verified using ParseToken or a Verifier, challenges should be single use
+func (c *StandardClaims) VerifyPossession(challenge []byte, sig []byte) error {
+	if c.PublicKey == "" {
+		return newVerificationError(ErrPossessionNotProven, nil, "no public key stored in the JWT")
+	}
+
+	if len(challenge) < PossessionChallengeSize {
+		return newVerificationError(ErrPossessionNotProven, nil, "challenge is too short")
+	}
+
+	pubK, err := hex.DecodeString(c.PublicKey)
+	if err != nil || len(pubK) != ed25519.PublicKeySize {
+		return newVerificationError(ErrPossessionNotProven, err, "invalid public key stored in the JWT")
+	}
+
+	ok, err := iu.Ed25519Verify(pubK, possessionData(challenge), sig)
+	if err != nil {
+		return newVerificationError(ErrPossessionNotProven, err, "invalid possession signature: %s", err)
+	}
+	if !ok {
+		return newVerificationError(ErrPossessionNotProven, nil, "invalid possession signature")
+	}
+
+	return nil
+}
+
+func possessionData(challenge []byte) []byte {
+	return []byte(fmt.Sprintf("%s.%s", possessionContext, hex.EncodeToString(challenge)))
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"time"
+
+	iu "github.com/choria-io/go-choria/internal/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Proof of possession", func() {
+	var (
+		pubK      ed25519.PublicKey
+		priK      ed25519.PrivateKey
+		challenge []byte
+		err       error
+	)
+
+	BeforeEach(func() {
+		pubK, priK = loadEd25519Seed("testdata/ed25519/signer.seed")
+		challenge, err = NewPossessionChallenge()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Describe("NewPossessionChallenge", func() {
+		It("Should create unique challenges", func() {
+			Expect(challenge).To(HaveLen(PossessionChallengeSize))
+
+			other, err := NewPossessionChallenge()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(other).ToNot(Equal(challenge))
+		})
+	})
+
+	Describe("SignPossessionChallenge", func() {
+		It("Should require an ed25519 signer", func() {
+			_, err := SignPossessionChallenge(challenge, mustSigner(loadRSAPriKey("testdata/rsa/signer-key.pem")))
+			Expect(err).To(MatchError("ed25519 signer required"))
+		})
+
+		It("Should require a valid challenge", func() {
+			_, err := SignPossessionChallenge([]byte("short"), mustSigner(priK))
+			Expect(err).To(MatchError("challenge is too short"))
+		})
+	})
+
+	Describe("VerifyPossession", func() {
+		It("Should verify client tokens", func() {
+			claims, err := NewClientIDClaims("up=ginkgo", nil, "", nil, "", "", time.Hour, nil, pubK)
+			Expect(err).ToNot(HaveOccurred())
+			t, err := SignToken(claims, mustSigner(loadRSAPriKey("testdata/rsa/signer-key.pem")))
+			Expect(err).ToNot(HaveOccurred())
+
+			client, err := ParseClientIDToken(t, loadRSAPubKey("testdata/rsa/signer-public.pem"), true)
+			Expect(err).ToNot(HaveOccurred())
+
+			sig, err := SignPossessionChallengeWithSeedFile(challenge, "testdata/ed25519/signer.seed")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.VerifyPossession(challenge, sig)).To(Succeed())
+		})
+
+		It("Should verify server tokens", func() {
+			server, err := NewServerClaims("example.net", []string{"choria"}, "", nil, nil, pubK, "", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+
+			sig, err := SignPossessionChallenge(challenge, mustSigner(priK))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.VerifyPossession(challenge, sig)).To(Succeed())
+		})
+
+		It("Should detect invalid proofs", func() {
+			server, err := NewServerClaims("example.net", []string{"choria"}, "", nil, nil, pubK, "", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, otherPriK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			sig, err := SignPossessionChallenge(challenge, mustSigner(otherPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			err = server.VerifyPossession(challenge, sig)
+			Expect(err).To(MatchError("invalid possession signature"))
+			Expect(errors.Is(err, ErrPossessionNotProven)).To(BeTrue())
+
+			sig, err = SignPossessionChallenge(challenge, mustSigner(priK))
+			Expect(err).ToNot(HaveOccurred())
+			other, err := NewPossessionChallenge()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.VerifyPossession(other, sig)).To(MatchError("invalid possession signature"))
+
+			// a plain signature of the challenge is not accepted
+			Expect(server.VerifyPossession(challenge, ed25519.Sign(priK, challenge))).To(MatchError("invalid possession signature"))
+
+			Expect(server.VerifyPossession([]byte("short"), sig)).To(MatchError("challenge is too short"))
+
+			server.PublicKey = ""
+			Expect(server.VerifyPossession(challenge, sig)).To(MatchError("no public key stored in the JWT"))
+			server.PublicKey = "x"
+			Expect(server.VerifyPossession(challenge, sig)).To(MatchError("invalid public key stored in the JWT"))
+		})
+	})
+})
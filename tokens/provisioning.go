@@ -31,6 +31,9 @@ type ProvisioningClaims struct {
 	StandardClaims
 }
 
+// ErrNotAProvisioningToken indicates a token is not a provisioning token
+var ErrNotAProvisioningToken error = newVerificationError(ErrWrongPurpose, nil, "not a provisioning token")
+
 // NewProvisioningClaims generates new ProvisioningClaims
 func NewProvisioningClaims(secure bool, byDefault bool, token string, user string, password string, urls []string, srvDomain string, registrationDataFile string, factsDataFile string, org string, issuer string, validity time.Duration) (*ProvisioningClaims, error) {
 	if org == "" {
@@ -70,32 +73,42 @@ func IsProvisioningToken(claims StandardClaims) bool {
 	return claims.Purpose == ProvisioningPurpose
 }
 
-// ParseProvisioningToken parses token and verifies it with pk
-func ParseProvisioningToken(token string, pk any) (*ProvisioningClaims, error) {
+// ParseProvisioningToken parses token and verifies it with pk, tokens issued by a chain issuer are verified through the trust chain to the org issuer pk
+func ParseProvisioningToken(token string, pk any, opts ...ParseOption) (*ProvisioningClaims, error) {
 	claims := &ProvisioningClaims{}
-	err := ParseToken(token, claims, pk)
+	err := ParseToken(token, claims, pk, opts...)
 	if err != nil {
-		return nil, fmt.Errorf("could not parse provisioner token: %s", err)
+		return nil, fmt.Errorf("could not parse provisioner token: %w", err)
 	}
 
 	if !IsProvisioningToken(claims.StandardClaims) {
-		return nil, fmt.Errorf("not a provisioning token")
+		return nil, ErrNotAProvisioningToken
 	}
 
-	if claims.OrganizationUnit == "" {
-		claims.OrganizationUnit = defaultOrg
+	err = claims.verified()
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// verified performs the checks needed once the signature of the token was verified
+func (p *ProvisioningClaims) verified() error {
+	if p.OrganizationUnit == "" {
+		p.OrganizationUnit = defaultOrg
 	}
 
 	// if we have a tcs we require an issuer expiry to be set and it to not have expired
-	if !claims.verifyIssuerExpiry(claims.TrustChainSignature != "") {
-		return nil, jwt.ErrTokenExpired
+	if !p.verifyIssuerExpiry(p.TrustChainSignature != "") {
+		return errIssuerExpired
 	}
 
-	return claims, nil
+	return nil
 }
 
-// ParseProvisioningTokenWithKeyfile parses token and verifies it with the RSA Public key in pkFile, does not support ed25519
-func ParseProvisioningTokenWithKeyfile(token string, pkFile string) (*ProvisioningClaims, error) {
+// ParseProvisioningTokenWithKeyfile parses token and verifies it with the RSA, ECDSA or ed25519 public key in pkFile
+func ParseProvisioningTokenWithKeyfile(token string, pkFile string, opts ...ParseOption) (*ProvisioningClaims, error) {
 	if pkFile == "" {
 		return nil, fmt.Errorf("invalid public key file")
 	}
@@ -105,12 +118,12 @@ func ParseProvisioningTokenWithKeyfile(token string, pkFile string) (*Provisioni
 		return nil, fmt.Errorf("could not read validation certificate: %s", err)
 	}
 
-	pk, err := readRSAOrED25519PublicData(certdat)
+	pk, err := readPublicKeyData(certdat)
 	if err != nil {
 		return nil, err
 	}
 
-	return ParseProvisioningToken(token, pk)
+	return ParseProvisioningToken(token, pk, opts...)
 }
 
 // ParseProvisionTokenUnverified parses the provisioning token in an unverified manner.
@@ -127,7 +140,7 @@ func ParseProvisionTokenUnverified(token string) (*ProvisioningClaims, error) {
 	}
 
 	if !IsProvisioningToken(claims.StandardClaims) {
-		return nil, fmt.Errorf("token is not a provisioning token")
+		return nil, newVerificationError(ErrWrongPurpose, nil, "token is not a provisioning token")
 	}
 
 	if claims.OrganizationUnit == "" {
@@ -7,8 +7,10 @@ package tokens
 import (
 	"crypto/ed25519"
 	"crypto/rand"
+	"errors"
 	"time"
 
+	iu "github.com/choria-io/go-choria/internal/util"
 	"github.com/golang-jwt/jwt/v4"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -29,19 +31,19 @@ var _ = Describe("ProvisioningClaims", func() {
 
 		claims, err := NewClientIDClaims("up=ginkgo", []string{"rpcutil"}, "choria", map[string]string{"group": "admins"}, "// opa policy", "Ginkgo", time.Hour, nil, pubK)
 		Expect(err).ToNot(HaveOccurred())
-		clientToken, err = SignToken(claims, loadRSAPriKey("testdata/rsa/signer-key.pem"))
+		clientToken, err = SignToken(claims, mustSigner(loadRSAPriKey("testdata/rsa/signer-key.pem")))
 		Expect(err).ToNot(HaveOccurred())
 
 		pclaims, err := NewProvisioningClaims(true, true, "x", "usr", "toomanysecrets", []string{"nats://example.net:4222"}, "example.net", "/reg.data", "/facts.json", "", "Ginkgo", time.Hour)
 		Expect(err).ToNot(HaveOccurred())
 		pclaims.Extensions = MapClaims{"hello": "world"}
-		validToken, err = SignToken(pclaims, loadRSAPriKey("testdata/rsa/signer-key.pem"))
+		validToken, err = SignToken(pclaims, mustSigner(loadRSAPriKey("testdata/rsa/signer-key.pem")))
 		Expect(err).ToNot(HaveOccurred())
 
 		pclaims, err = NewProvisioningClaims(true, true, "x", "usr", "toomanysecrets", []string{"nats://example.net:4222"}, "example.net", "/reg.data", "/facts.json", "", "Ginkgo", time.Hour)
 		Expect(err).ToNot(HaveOccurred())
 		pclaims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-1 * time.Hour))
-		expiredToken, err = SignToken(pclaims, loadRSAPriKey("testdata/rsa/signer-key.pem"))
+		expiredToken, err = SignToken(pclaims, mustSigner(loadRSAPriKey("testdata/rsa/signer-key.pem")))
 		Expect(err).ToNot(HaveOccurred())
 	})
 
@@ -113,6 +115,107 @@ var _ = Describe("ProvisioningClaims", func() {
 		})
 	})
 
+	Describe("Chain issued tokens", func() {
+		var (
+			orgPubK     ed25519.PublicKey
+			orgPriK     ed25519.PrivateKey
+			handler     *ClientIDClaims
+			handlerPriK ed25519.PrivateKey
+		)
+
+		newHandler := func(grant *ChainGrant) {
+			var handlerPubK ed25519.PublicKey
+			handlerPubK, handlerPriK, err = iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+
+			handler, err = NewClientIDClaims("choria=portal", nil, "", nil, "", "", time.Hour, nil, handlerPubK)
+			Expect(err).ToNot(HaveOccurred())
+			handler.ChainGrant = grant
+			Expect(handler.AddOrgIssuerData(mustSigner(orgPriK))).To(Succeed())
+		}
+
+		newToken := func(ou string) string {
+			pclaims, err := NewProvisioningClaims(true, true, "x", "", "", []string{"nats://example.net:4222"}, "", "", "", ou, "", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pclaims.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+
+			t, err := SignToken(pclaims, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			return t
+		}
+
+		BeforeEach(func() {
+			orgPubK, orgPriK, err = iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			newHandler(nil)
+		})
+
+		It("Should verify the chain to the org issuer", func() {
+			t, err := ParseProvisioningToken(newToken(""), orgPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(t.Issuer).To(Equal("C-" + handler.ID + "." + handler.PublicKey))
+			Expect(t.OrganizationUnit).To(Equal("choria"))
+
+			v, err := NewVerifier(WithTrustedKeys(orgPubK))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = v.VerifyProvisioning(newToken(""))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should not verify against the chain issuer directly", func() {
+			handlerPubK := handlerPriK.Public().(ed25519.PublicKey)
+			_, err := ParseProvisioningToken(newToken(""), handlerPubK)
+			Expect(err).To(MatchError("could not parse provisioner token: not signed by issuer: invalid org issuer signature for chain issuer " + handler.ID))
+			Expect(errors.Is(err, ErrChainSignatureInvalid)).To(BeTrue())
+		})
+
+		It("Should detect chain issuers not issued by the org issuer", func() {
+			otherPubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseProvisioningToken(newToken(""), otherPubK)
+			Expect(errors.Is(err, ErrChainSignatureInvalid)).To(BeTrue())
+		})
+
+		It("Should detect tokens signed outside the chain", func() {
+			_, roguePriK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+
+			pclaims, err := NewProvisioningClaims(true, true, "x", "", "", []string{"nats://example.net:4222"}, "", "", "", "", "", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pclaims.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+			t, err := SignToken(pclaims, mustSigner(roguePriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseProvisioningToken(t, orgPubK)
+			Expect(err).To(MatchError("could not parse provisioner token: ed25519: verification error"))
+		})
+
+		It("Should enforce chain revocations", func() {
+			list, err := NewRevocationListClaims("", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(list.RevokeChainIssuer(handler.ID)).To(Succeed())
+
+			_, err = ParseProvisioningToken(newToken(""), orgPubK, WithRevocations(list))
+			Expect(errors.Is(err, ErrRevoked)).To(BeTrue())
+		})
+
+		It("Should enforce chain grants", func() {
+			newHandler(&ChainGrant{OrganizationUnits: []string{"choria"}})
+			_, err := ParseProvisioningToken(newToken(""), orgPubK)
+			Expect(err).To(MatchError("could not parse provisioner token: provisioning tokens are not granted by chain issuer " + handler.ID))
+			Expect(errors.Is(err, ErrExceedsGrant)).To(BeTrue())
+
+			newHandler(&ChainGrant{OrganizationUnits: []string{"choria"}, Provisioning: true})
+			_, err = ParseProvisioningToken(newToken(""), orgPubK)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseProvisioningToken(newToken("other"), orgPubK)
+			Expect(err).To(MatchError("could not parse provisioner token: organization unit other is not granted by chain issuer " + handler.ID))
+		})
+	})
+
 	Describe("ParseProvisioningTokenWithKeyfile", func() {
 		It("Should parse the token", func() {
 			t, err := ParseProvisioningTokenWithKeyfile(validToken, "testdata/rsa/signer-public.pem")
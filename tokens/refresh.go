@@ -0,0 +1,380 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// RenewFunc obtains a renewed token for token, typically by calling RenewToken or a remote issuing service
+type RenewFunc func(ctx context.Context, token string) (string, error)
+
+// RenewWithSigner is a RenewFunc that verifies the token using pk and renews it using signer, see RenewToken and WithRenewParseOptions
+func RenewWithSigner(pk any, signer Signer, opts ...RenewOption) RenewFunc {
+	return func(_ context.Context, token string) (string, error) {
+		return RenewToken(token, pk, signer, opts...)
+	}
+}
+
+// RefreshManager keeps a token stored in a file renewed, it renews the token once a portion of its lifetime has
+// passed, writes the renewed token to the file and notifies subscribers of the new token
+type RefreshManager struct {
+	file         string
+	renew        RenewFunc
+	threshold    float64
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	pollInterval time.Duration
+	log          *logrus.Entry
+
+	token       []byte
+	claims      *StandardClaims
+	subscribers []chan string
+	mu          sync.Mutex
+}
+
+// RefreshOption configures a RefreshManager
+type RefreshOption func(*RefreshManager) error
+
+// WithRefreshThreshold sets the portion of the token lifetime after which it is renewed, defaults to 0.75
+func WithRefreshThreshold(threshold float64) RefreshOption {
+	return func(m *RefreshManager) error {
+		if threshold <= 0 || threshold >= 1 {
+			return fmt.Errorf("threshold must be between 0 and 1")
+		}
+
+		m.threshold = threshold
+		return nil
+	}
+}
+
+// WithRefreshBackoff sets the minimum and maximum time to wait between failed renewals, defaults to 1 second and 5 minutes
+func WithRefreshBackoff(min time.Duration, max time.Duration) RefreshOption {
+	return func(m *RefreshManager) error {
+		if min <= 0 || max < min {
+			return fmt.Errorf("invalid backoff")
+		}
+
+		m.minBackoff = min
+		m.maxBackoff = max
+		return nil
+	}
+}
+
+// WithRefreshPollInterval sets how often the token file is checked for changes made by others, defaults to 1 minute
+func WithRefreshPollInterval(interval time.Duration) RefreshOption {
+	return func(m *RefreshManager) error {
+		if interval <= 0 {
+			return fmt.Errorf("poll interval must be positive")
+		}
+
+		m.pollInterval = interval
+		return nil
+	}
+}
+
+// WithRefreshLogger sets the logger used to report renewals and failures
+func WithRefreshLogger(log *logrus.Entry) RefreshOption {
+	return func(m *RefreshManager) error {
+		if log == nil {
+			return fmt.Errorf("logger is required")
+		}
+
+		m.log = log
+		return nil
+	}
+}
+
+// NewRefreshManager creates a RefreshManager for the token stored in file that renews it using renew
+func NewRefreshManager(file string, renew RenewFunc, opts ...RefreshOption) (*RefreshManager, error) {
+	if file == "" {
+		return nil, fmt.Errorf("token file is required")
+	}
+	if renew == nil {
+		return nil, fmt.Errorf("renew function is required")
+	}
+
+	m := &RefreshManager{
+		file:         file,
+		renew:        renew,
+		threshold:    0.75,
+		minBackoff:   time.Second,
+		maxBackoff:   5 * time.Minute,
+		pollInterval: time.Minute,
+	}
+
+	for _, opt := range opts {
+		err := opt(m)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if m.log == nil {
+		log := logrus.New()
+		log.SetOutput(io.Discard)
+		m.log = logrus.NewEntry(log)
+	}
+
+	_, err := m.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// RenewalDeadline is the time after which a token should be renewed, threshold is the portion of the token lifetime
+// that should pass before renewal. The lifetime ends at ExpireTime() so chained tokens are renewed before their issuer expires
+func RenewalDeadline(claims *StandardClaims, threshold float64) time.Time {
+	expires := claims.ExpireTime()
+	if expires.IsZero() {
+		return time.Time{}
+	}
+
+	start := time.Now()
+	if claims.IssuedAt != nil {
+		start = claims.IssuedAt.Time
+	}
+
+	if !expires.After(start) {
+		return start
+	}
+
+	return start.Add(time.Duration(float64(expires.Sub(start)) * threshold))
+}
+
+// Token is the current token
+func (m *RefreshManager) Token() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return string(m.token)
+}
+
+// Deadline is the time the current token will be renewed, zero when the token does not expire
+func (m *RefreshManager) Deadline() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return RenewalDeadline(m.claims, m.threshold)
+}
+
+// Subscribe returns a channel that receives every new token, when the receiver is slow only the latest token is kept
+func (m *RefreshManager) Subscribe() <-chan string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ch := make(chan string, 1)
+	m.subscribers = append(m.subscribers, ch)
+
+	return ch
+}
+
+// Run renews the token as needed until ctx is canceled
+func (m *RefreshManager) Run(ctx context.Context) error {
+	poll := time.NewTicker(m.pollInterval)
+	defer poll.Stop()
+
+	// retryAt is when a failed renewal is retried, it is absolute so polling does not postpone the retry
+	var retryAt time.Time
+	backoff := time.Duration(0)
+
+	for {
+		wait := time.Until(retryAt)
+		if retryAt.IsZero() {
+			deadline := m.Deadline()
+			if deadline.IsZero() {
+				// tokens that do not expire are never renewed but might be replaced
+				wait = m.pollInterval
+			} else {
+				wait = time.Until(deadline)
+			}
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-timer.C:
+			if m.Deadline().IsZero() {
+				continue
+			}
+
+			err := m.renewToken(ctx)
+			if err == nil && !m.Deadline().After(time.Now()) {
+				// renewing again straight away would not help, retry as if renewal failed
+				err = fmt.Errorf("renewed token is already due for renewal")
+			}
+			if err == nil {
+				backoff = 0
+				retryAt = time.Time{}
+				continue
+			}
+
+			backoff = m.nextBackoff(backoff)
+			retryAt = time.Now().Add(backoff)
+			m.log.Errorf("Could not renew token %s, retrying in %v: %v", m.file, backoff, err)
+
+		case <-poll.C:
+			timer.Stop()
+
+			changed, err := m.load()
+			if err != nil {
+				m.log.Errorf("Could not reload token %s: %v", m.file, err)
+			} else if changed {
+				m.log.Infof("Reloaded changed token %s", m.file)
+				backoff = 0
+				retryAt = time.Time{}
+			}
+
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (m *RefreshManager) nextBackoff(current time.Duration) time.Duration {
+	if current == 0 {
+		return m.minBackoff
+	}
+
+	next := current * 2
+	if next > m.maxBackoff {
+		return m.maxBackoff
+	}
+
+	return next
+}
+
+func (m *RefreshManager) renewToken(ctx context.Context) error {
+	token := m.Token()
+
+	renewed, err := m.renew(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	claims, err := parseStandardClaimsUnverified([]byte(renewed))
+	if err != nil {
+		return fmt.Errorf("invalid renewed token: %w", err)
+	}
+
+	if claims.ExpiresAt == nil || !claims.ExpireTime().After(time.Now()) {
+		return fmt.Errorf("renewed token has expired")
+	}
+
+	err = writeFileAtomic(m.file, []byte(renewed))
+	if err != nil {
+		return err
+	}
+
+	m.set([]byte(renewed), claims)
+	m.log.Infof("Renewed token %s, expires at %v", m.file, claims.ExpireTime())
+
+	return nil
+}
+
+// load reads the token file and notifies subscribers when it changed
+func (m *RefreshManager) load() (bool, error) {
+	dat, err := os.ReadFile(m.file)
+	if err != nil {
+		return false, err
+	}
+	dat = bytes.TrimSpace(dat)
+
+	m.mu.Lock()
+	same := bytes.Equal(dat, m.token)
+	m.mu.Unlock()
+	if same {
+		return false, nil
+	}
+
+	claims, err := parseStandardClaimsUnverified(dat)
+	if err != nil {
+		return false, fmt.Errorf("invalid token in %s: %w", m.file, err)
+	}
+
+	m.set(dat, claims)
+
+	return true, nil
+}
+
+func (m *RefreshManager) set(token []byte, claims *StandardClaims) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.token = token
+	m.claims = claims
+
+	for _, ch := range m.subscribers {
+		// drop any unread token so that subscribers receive the latest one
+		select {
+		case <-ch:
+		default:
+		}
+
+		ch <- string(token)
+	}
+}
+
+func parseStandardClaimsUnverified(token []byte) (*StandardClaims, error) {
+	claims := &StandardClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(string(token), claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// writeFileAtomic replaces file with dat such that readers never observe a partially written file
+func writeFileAtomic(file string, dat []byte) error {
+	perm := os.FileMode(0600)
+	stat, err := os.Stat(file)
+	if err == nil {
+		perm = stat.Mode().Perm()
+	}
+
+	tf, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+
+	_, err = tf.Write(dat)
+	if err != nil {
+		tf.Close()
+		return err
+	}
+
+	err = tf.Sync()
+	if err != nil {
+		tf.Close()
+		return err
+	}
+
+	err = tf.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tf.Name(), perm)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tf.Name(), file)
+}
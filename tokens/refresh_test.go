@@ -0,0 +1,211 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RefreshManager", func() {
+	var (
+		file    string
+		signer  Signer
+		pubK    any
+		renewFn RenewFunc
+		ctx     context.Context
+		cancel  context.CancelFunc
+	)
+
+	newToken := func(validity time.Duration) string {
+		claims, err := NewClientIDClaims("up=ginkgo", nil, "", nil, "", "", validity, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		t, err := SignToken(claims, signer)
+		Expect(err).ToNot(HaveOccurred())
+		return t
+	}
+
+	BeforeEach(func() {
+		file = filepath.Join(GinkgoT().TempDir(), "token.jwt")
+		signer = mustSigner(loadRSAPriKey("testdata/rsa/signer-key.pem"))
+		pubK = loadRSAPubKey("testdata/rsa/signer-public.pem")
+		renewFn = RenewWithSigner(pubK, signer, WithRenewValidity(time.Hour))
+
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		DeferCleanup(func() { cancel() })
+	})
+
+	Describe("RenewalDeadline", func() {
+		It("Should calculate the deadline", func() {
+			claims := &StandardClaims{}
+			Expect(RenewalDeadline(claims, 0.5).IsZero()).To(BeTrue())
+
+			now := time.Now()
+			claims.IssuedAt = jwt.NewNumericDate(now)
+			claims.ExpiresAt = jwt.NewNumericDate(now.Add(time.Hour))
+			Expect(RenewalDeadline(claims, 0.5)).To(BeTemporally("~", now.Add(30*time.Minute), time.Second))
+
+			claims.IssuerExpiresAt = jwt.NewNumericDate(now.Add(20 * time.Minute))
+			claims.Issuer = "C-x.y"
+			claims.TrustChainSignature = "x.y"
+			Expect(RenewalDeadline(claims, 0.5)).To(BeTemporally("~", now.Add(10*time.Minute), time.Second))
+		})
+	})
+
+	Describe("NewRefreshManager", func() {
+		It("Should validate the options", func() {
+			_, err := NewRefreshManager("", renewFn)
+			Expect(err).To(MatchError("token file is required"))
+
+			_, err = NewRefreshManager(file, nil)
+			Expect(err).To(MatchError("renew function is required"))
+
+			_, err = NewRefreshManager(file, renewFn, WithRefreshThreshold(1))
+			Expect(err).To(MatchError("threshold must be between 0 and 1"))
+
+			_, err = NewRefreshManager(file, renewFn, WithRefreshBackoff(time.Minute, time.Second))
+			Expect(err).To(MatchError("invalid backoff"))
+
+			_, err = NewRefreshManager(file, renewFn)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			Expect(os.WriteFile(file, []byte("x"), 0600)).To(Succeed())
+			_, err = NewRefreshManager(file, renewFn)
+			Expect(err).To(MatchError(ContainSubstring("invalid token in " + file)))
+		})
+	})
+
+	Describe("Run", func() {
+		It("Should renew the token before it expires", func() {
+			t := newToken(2 * time.Second)
+			Expect(os.WriteFile(file, []byte(t+"\n"), 0640)).To(Succeed())
+
+			m, err := NewRefreshManager(file, renewFn, WithRefreshThreshold(0.5))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m.Token()).To(Equal(t))
+			Expect(m.Deadline()).To(BeTemporally("<", time.Now().Add(2*time.Second)))
+
+			updates := m.Subscribe()
+			go m.Run(ctx)
+
+			var renewed string
+			Eventually(updates, 5*time.Second).Should(Receive(&renewed))
+			Expect(renewed).ToNot(Equal(t))
+			Expect(m.Token()).To(Equal(renewed))
+
+			dat, err := os.ReadFile(file)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(dat)).To(Equal(renewed))
+
+			stat, err := os.Stat(file)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stat.Mode().Perm()).To(Equal(os.FileMode(0640)))
+
+			client, err := ParseClientIDToken(renewed, pubK, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.ExpiresAt.Time).To(BeTemporally("~", time.Now().Add(time.Hour), 2*time.Second))
+			Expect(m.Deadline()).To(BeTemporally(">", time.Now().Add(29*time.Minute)))
+		})
+
+		It("Should retry failed renewals", func() {
+			Expect(os.WriteFile(file, []byte(newToken(time.Second)), 0600)).To(Succeed())
+
+			var calls int32
+			failing := func(ctx context.Context, token string) (string, error) {
+				if atomic.AddInt32(&calls, 1) < 3 {
+					return "", fmt.Errorf("simulated failure")
+				}
+				return renewFn(ctx, token)
+			}
+
+			m, err := NewRefreshManager(file, failing, WithRefreshBackoff(10*time.Millisecond, 20*time.Millisecond))
+			Expect(err).ToNot(HaveOccurred())
+
+			updates := m.Subscribe()
+			go m.Run(ctx)
+
+			Eventually(updates, 5*time.Second).Should(Receive())
+			Expect(atomic.LoadInt32(&calls)).To(Equal(int32(3)))
+		})
+
+		It("Should retry failed renewals with backoffs longer than the poll interval", func() {
+			Expect(os.WriteFile(file, []byte(newToken(5*time.Second)), 0600)).To(Succeed())
+
+			var calls int32
+			failing := func(ctx context.Context, token string) (string, error) {
+				if atomic.AddInt32(&calls, 1) < 3 {
+					return "", fmt.Errorf("simulated failure")
+				}
+				return renewFn(ctx, token)
+			}
+
+			m, err := NewRefreshManager(file, failing, WithRefreshThreshold(0.1), WithRefreshBackoff(300*time.Millisecond, 300*time.Millisecond), WithRefreshPollInterval(100*time.Millisecond))
+			Expect(err).ToNot(HaveOccurred())
+
+			updates := m.Subscribe()
+			go m.Run(ctx)
+
+			Eventually(updates, 5*time.Second).Should(Receive())
+			Expect(atomic.LoadInt32(&calls)).To(Equal(int32(3)))
+		})
+
+		It("Should back off when renewed tokens are already due for renewal", func() {
+			Expect(os.WriteFile(file, []byte(newToken(time.Second)), 0600)).To(Succeed())
+
+			claims, err := NewClientIDClaims("up=ginkgo", nil, "", nil, "", "", time.Hour, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			claims.IssuedAt = jwt.NewNumericDate(time.Now().Add(-10 * time.Hour))
+			due, err := SignToken(claims, signer)
+			Expect(err).ToNot(HaveOccurred())
+
+			var calls int32
+			renew := func(_ context.Context, _ string) (string, error) {
+				atomic.AddInt32(&calls, 1)
+				return due, nil
+			}
+
+			m, err := NewRefreshManager(file, renew, WithRefreshBackoff(50*time.Millisecond, time.Second))
+			Expect(err).ToNot(HaveOccurred())
+
+			updates := m.Subscribe()
+			go m.Run(ctx)
+
+			Eventually(updates, 5*time.Second).Should(Receive(Equal(due)))
+			Consistently(func() int32 { return atomic.LoadInt32(&calls) }, 200*time.Millisecond).Should(BeNumerically("<=", 4))
+		})
+
+		It("Should detect tokens replaced by others", func() {
+			Expect(os.WriteFile(file, []byte(newToken(time.Hour)), 0600)).To(Succeed())
+
+			m, err := NewRefreshManager(file, renewFn, WithRefreshPollInterval(10*time.Millisecond))
+			Expect(err).ToNot(HaveOccurred())
+
+			updates := m.Subscribe()
+			go m.Run(ctx)
+
+			t := newToken(time.Hour)
+			Expect(os.WriteFile(file, []byte(t), 0600)).To(Succeed())
+			Eventually(updates).Should(Receive(Equal(t)))
+		})
+
+		It("Should stop when the context is canceled", func() {
+			Expect(os.WriteFile(file, []byte(newToken(time.Hour)), 0600)).To(Succeed())
+
+			m, err := NewRefreshManager(file, renewFn)
+			Expect(err).ToNot(HaveOccurred())
+
+			cancel()
+			Expect(m.Run(ctx)).To(MatchError(context.Canceled))
+		})
+	})
+})
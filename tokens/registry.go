@@ -0,0 +1,168 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// PurposeDefinition describes how tokens of a purpose are parsed and verified, see RegisterPurpose
+type PurposeDefinition struct {
+	// Purpose is the purpose of the tokens
+	Purpose Purpose
+
+	// New creates the empty claims tokens are parsed into, must always return the same pointer type
+	New func() Claims
+
+	// ChainIssued indicates tokens can be issued by chain issuers, these are verified through their trust chain to the org issuer
+	ChainIssued bool
+
+	// ValidateGrant checks that claims do not exceed the grant of a chain issuer in their trust chain, required when ChainIssued is set
+	ValidateGrant func(claims Claims, grant *ChainGrant) error
+
+	// Verified is called once the signature, trust chain and standard claims of a token was verified and may perform further checks
+	Verified func(claims Claims) error
+}
+
+var (
+	purposes       = map[Purpose]*PurposeDefinition{}
+	purposesByType = map[reflect.Type]*PurposeDefinition{}
+	purposesMu     sync.RWMutex
+)
+
+func init() {
+	for _, def := range []PurposeDefinition{
+		{
+			Purpose:       ClientIDPurpose,
+			New:           func() Claims { return &ClientIDClaims{} },
+			ChainIssued:   true,
+			ValidateGrant: func(c Claims, g *ChainGrant) error { return g.ValidateClient(c.(*ClientIDClaims)) },
+			Verified:      func(c Claims) error { return c.(*ClientIDClaims).verified() },
+		},
+		{
+			Purpose:       ServerPurpose,
+			New:           func() Claims { return &ServerClaims{} },
+			ChainIssued:   true,
+			ValidateGrant: func(c Claims, g *ChainGrant) error { return g.ValidateServer(c.(*ServerClaims)) },
+			Verified:      func(c Claims) error { return c.(*ServerClaims).verified() },
+		},
+		{
+			Purpose:       ProvisioningPurpose,
+			New:           func() Claims { return &ProvisioningClaims{} },
+			ChainIssued:   true,
+			ValidateGrant: func(c Claims, g *ChainGrant) error { return g.ValidateProvisioning(c.(*ProvisioningClaims)) },
+			Verified:      func(c Claims) error { return c.(*ProvisioningClaims).verified() },
+		},
+		{
+			Purpose: RevocationListPurpose,
+			New:     func() Claims { return &RevocationListClaims{} },
+		},
+	} {
+		err := RegisterPurpose(def)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterPurpose registers a token purpose so that ParseAny can parse and verify its tokens, this allows
+// packages to define their own tokens by embedding StandardClaims in their claims.
+//
+// Server token requests are not registered as they are verified against the key they hold, see ParseServerTokenRequest
+func RegisterPurpose(def PurposeDefinition) error {
+	if def.Purpose == UnknownPurpose {
+		return fmt.Errorf("purpose is required")
+	}
+
+	if def.New == nil {
+		return fmt.Errorf("claims constructor is required")
+	}
+
+	if def.ChainIssued && def.ValidateGrant == nil {
+		return fmt.Errorf("grant validator is required for chain issued purposes")
+	}
+
+	claims := def.New()
+	if claims == nil {
+		return fmt.Errorf("claims constructor returned nil")
+	}
+	ct := reflect.TypeOf(claims)
+
+	purposesMu.Lock()
+	defer purposesMu.Unlock()
+
+	if _, ok := purposes[def.Purpose]; ok {
+		return fmt.Errorf("purpose %s is already registered", def.Purpose)
+	}
+
+	if existing, ok := purposesByType[ct]; ok {
+		return fmt.Errorf("claims type %v is already registered for purpose %s", ct, existing.Purpose)
+	}
+
+	purposes[def.Purpose] = &def
+	purposesByType[ct] = &def
+
+	return nil
+}
+
+// RegisteredPurposes are all the purposes ParseAny can parse
+func RegisteredPurposes() []Purpose {
+	purposesMu.RLock()
+	defer purposesMu.RUnlock()
+
+	res := make([]Purpose, 0, len(purposes))
+	for p := range purposes {
+		res = append(res, p)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+
+	return res
+}
+
+// lookupPurpose finds the definition for purpose, nil when not registered
+func lookupPurpose(purpose Purpose) *PurposeDefinition {
+	purposesMu.RLock()
+	defer purposesMu.RUnlock()
+
+	return purposes[purpose]
+}
+
+// purposeForClaims finds the definition claims were registered with, nil when not registered
+func purposeForClaims(claims any) *PurposeDefinition {
+	purposesMu.RLock()
+	defer purposesMu.RUnlock()
+
+	return purposesByType[reflect.TypeOf(claims)]
+}
+
+// ParseAny parses and verifies token using pk and opts, see ParseToken, returning claims of the type registered
+// for its purpose, callers type switch on the result:
+//
+//	claims, err := tokens.ParseAny(token, pk)
+//	switch c := claims.(type) {
+//	case *tokens.ClientIDClaims:
+//	case *tokens.ServerClaims:
+//	}
+func ParseAny(token string, pk any, opts ...ParseOption) (Claims, error) {
+	parsed, err := NewParsedToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if lookupPurpose(parsed.Purpose()) == nil {
+		return nil, newVerificationError(ErrWrongPurpose, nil, "unsupported token purpose %q", parsed.Purpose())
+	}
+
+	err = parsed.Verify(pk, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return parsed.Claims(), nil
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	iu "github.com/choria-io/go-choria/internal/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const testAgentPurpose Purpose = "ginkgo_agent"
+
+type testAgentClaims struct {
+	Agent string `json:"agent"`
+
+	StandardClaims
+}
+
+var registerTestPurpose sync.Once
+
+// registerTestAgentPurpose registers testAgentPurpose, agents must be set and granted by chain issuers
+func registerTestAgentPurpose() {
+	registerTestPurpose.Do(func() {
+		Expect(RegisterPurpose(PurposeDefinition{
+			Purpose:     testAgentPurpose,
+			New:         func() Claims { return &testAgentClaims{} },
+			ChainIssued: true,
+			ValidateGrant: func(c Claims, g *ChainGrant) error {
+				if !matchesAnyPattern(g.Agents, c.(*testAgentClaims).Agent) {
+					return fmt.Errorf("agent %s is not granted", c.(*testAgentClaims).Agent)
+				}
+				return nil
+			},
+			Verified: func(c Claims) error {
+				if c.(*testAgentClaims).Agent == "" {
+					return fmt.Errorf("agent is required")
+				}
+				return nil
+			},
+		})).To(Succeed())
+	})
+}
+
+var _ = Describe("Registry", func() {
+	var (
+		orgPubK ed25519.PublicKey
+		orgPriK ed25519.PrivateKey
+		err     error
+	)
+
+	newAgent := func(agent string) *testAgentClaims {
+		std, err := newStandardClaims("", testAgentPurpose, time.Hour, false)
+		Expect(err).ToNot(HaveOccurred())
+		return &testAgentClaims{Agent: agent, StandardClaims: *std}
+	}
+
+	BeforeEach(func() {
+		orgPubK, orgPriK, err = iu.Ed25519KeyPair()
+		Expect(err).ToNot(HaveOccurred())
+
+		registerTestAgentPurpose()
+	})
+
+	Describe("RegisterPurpose", func() {
+		It("Should validate the definition", func() {
+			Expect(RegisterPurpose(PurposeDefinition{New: func() Claims { return &testAgentClaims{} }})).To(MatchError("purpose is required"))
+			Expect(RegisterPurpose(PurposeDefinition{Purpose: "x"})).To(MatchError("claims constructor is required"))
+			Expect(RegisterPurpose(PurposeDefinition{Purpose: "x", New: func() Claims { return nil }})).To(MatchError("claims constructor returned nil"))
+			Expect(RegisterPurpose(PurposeDefinition{Purpose: "x", New: func() Claims { return &testAgentClaims{} }, ChainIssued: true})).To(MatchError("grant validator is required for chain issued purposes"))
+		})
+
+		It("Should not allow duplicates", func() {
+			Expect(RegisterPurpose(PurposeDefinition{Purpose: ServerPurpose, New: func() Claims { return &StandardClaims{} }})).To(MatchError("purpose choria_server is already registered"))
+			Expect(RegisterPurpose(PurposeDefinition{Purpose: "x", New: func() Claims { return &ServerClaims{} }})).To(MatchError("claims type *tokens.ServerClaims is already registered for purpose choria_server"))
+		})
+
+		It("Should list the registered purposes", func() {
+			Expect(RegisteredPurposes()).To(Equal([]Purpose{ClientIDPurpose, ProvisioningPurpose, RevocationListPurpose, ServerPurpose, testAgentPurpose}))
+		})
+	})
+
+	Describe("ParseAny", func() {
+		It("Should parse built in purposes", func() {
+			pubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+
+			server, err := NewServerClaims("n1.example.net", []string{"choria"}, "", nil, nil, pubK, "", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			t, err := SignToken(server, mustSigner(orgPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			claims, err := ParseAny(t, orgPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(claims).To(BeAssignableToTypeOf(&ServerClaims{}))
+			Expect(claims.(*ServerClaims).ChoriaIdentity).To(Equal("n1.example.net"))
+
+			prov, err := NewProvisioningClaims(true, true, "x", "", "", []string{"nats://example.net:4222"}, "", "", "", "", "", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			prov.OrganizationUnit = ""
+			t, err = SignToken(prov, mustSigner(orgPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			claims, err = ParseAny(t, orgPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(claims.(*ProvisioningClaims).OrganizationUnit).To(Equal("choria"))
+		})
+
+		It("Should verify the token", func() {
+			pubK, priK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+
+			client, err := NewClientIDClaims("up=ginkgo", nil, "", nil, "", "", time.Hour, nil, pubK)
+			Expect(err).ToNot(HaveOccurred())
+			t, err := SignToken(client, mustSigner(priK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseAny(t, orgPubK)
+			Expect(err).To(MatchError("could not parse choria_client_id token: ed25519: verification error"))
+		})
+
+		It("Should reject unknown purposes", func() {
+			std, err := newStandardClaims("", "other", time.Hour, false)
+			Expect(err).ToNot(HaveOccurred())
+			t, err := SignToken(std, mustSigner(orgPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseAny(t, orgPubK)
+			Expect(err).To(MatchError(`unsupported token purpose "other"`))
+			Expect(errors.Is(err, ErrWrongPurpose)).To(BeTrue())
+		})
+
+		It("Should parse registered purposes and call their hooks", func() {
+			t, err := SignToken(newAgent("rpcutil"), mustSigner(orgPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			claims, err := ParseAny(t, orgPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(claims.(*testAgentClaims).Agent).To(Equal("rpcutil"))
+
+			t, err = SignToken(newAgent(""), mustSigner(orgPriK))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = ParseAny(t, orgPubK)
+			Expect(err).To(MatchError("agent is required"))
+		})
+
+		It("Should verify chain issued registered purposes through the chain", func() {
+			issuerPubK, issuerPriK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			issuer, err := NewClientIDClaims("choria=issuer", nil, "", nil, "", "", time.Hour, nil, issuerPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(issuer.AddOrgIssuerData(mustSigner(orgPriK))).To(Succeed())
+
+			agentPubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			agent := newAgent("rpcutil")
+			agent.PublicKey = hex.EncodeToString(agentPubK)
+			Expect(agent.AddChainIssuerData(issuer, mustSigner(issuerPriK))).To(Succeed())
+			t, err := SignToken(agent, mustSigner(issuerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			claims, err := ParseAny(t, orgPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(claims.(*testAgentClaims).Issuer).To(HavePrefix(ChainIssuerPrefix))
+
+			otherPubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = ParseAny(t, otherPubK)
+			Expect(errors.Is(err, ErrChainSignatureInvalid)).To(BeTrue())
+		})
+
+		It("Should check chain issued registered purposes against the chain grants", func() {
+			issuerPubK, issuerPriK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			issuer, err := NewClientIDClaims("choria=issuer", nil, "", nil, "", "", time.Hour, nil, issuerPubK)
+			Expect(err).ToNot(HaveOccurred())
+			issuer.ChainGrant = &ChainGrant{Agents: []string{"rpcutil"}}
+			Expect(issuer.AddOrgIssuerData(mustSigner(orgPriK))).To(Succeed())
+
+			agentPubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, name := range []string{"rpcutil", "puppet"} {
+				agent := newAgent(name)
+				agent.PublicKey = hex.EncodeToString(agentPubK)
+				Expect(agent.AddChainIssuerData(issuer, mustSigner(issuerPriK))).To(Succeed())
+				t, err := SignToken(agent, mustSigner(issuerPriK))
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = ParseAny(t, orgPubK)
+				if name == "rpcutil" {
+					Expect(err).ToNot(HaveOccurred())
+					continue
+				}
+
+				Expect(err).To(MatchError("could not parse ginkgo_agent token: agent puppet is not granted by chain issuer " + issuer.ID))
+				Expect(errors.Is(err, ErrExceedsGrant)).To(BeTrue())
+			}
+		})
+	})
+})
@@ -0,0 +1,285 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/segmentio/ksuid"
+)
+
+// RenewOption configures how tokens are renewed
+type RenewOption func(*renewOpts) error
+
+type renewOpts struct {
+	validity    time.Duration
+	publicKey   ed25519.PublicKey
+	chainIssuer *ClientIDClaims
+	orgIssuer   Signer
+	parseOpts   []ParseOption
+	now         func() time.Time
+}
+
+// WithRenewValidity sets the validity of the renewed token, defaults to the validity of the original token
+func WithRenewValidity(validity time.Duration) RenewOption {
+	return func(o *renewOpts) error {
+		if validity <= 0 {
+			return fmt.Errorf("validity must be positive")
+		}
+
+		o.validity = validity
+		return nil
+	}
+}
+
+// WithRenewPublicKey replaces the public key of the token while renewing it
+func WithRenewPublicKey(pk ed25519.PublicKey) RenewOption {
+	return func(o *renewOpts) error {
+		if len(pk) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid public key")
+		}
+
+		o.publicKey = pk
+		return nil
+	}
+}
+
+// WithRenewChainIssuer moves a token issued by a chain issuer to chainIssuer while renewing it, typically a renewed
+// token of the original chain issuer whose expiry would otherwise limit the renewed token
+func WithRenewChainIssuer(chainIssuer *ClientIDClaims) RenewOption {
+	return func(o *renewOpts) error {
+		if chainIssuer == nil {
+			return fmt.Errorf("chain issuer is required")
+		}
+
+		o.chainIssuer = chainIssuer
+		return nil
+	}
+}
+
+// WithRenewOrgIssuer sets the org issuer used to sign the chain data of chain issuers, needed when the token signer is not the org issuer
+func WithRenewOrgIssuer(signer Signer) RenewOption {
+	return func(o *renewOpts) error {
+		if signer == nil {
+			return fmt.Errorf("signer is required")
+		}
+
+		o.orgIssuer = signer
+		return nil
+	}
+}
+
+// WithRenewParseOptions sets options used when verifying the token in RenewToken, like WithRevocations or WithIssuerEndorsements
+func WithRenewParseOptions(opts ...ParseOption) RenewOption {
+	return func(o *renewOpts) error {
+		o.parseOpts = append(o.parseOpts, opts...)
+		return nil
+	}
+}
+
+// RenewToken verifies token using pk, including the checks registered for its purpose, and reissues it, see Renew
+func RenewToken(token string, pk any, signer Signer, opts ...RenewOption) (string, error) {
+	ropts, err := newRenewOpts(opts)
+	if err != nil {
+		return "", err
+	}
+
+	parsed, err := NewParsedToken(token)
+	if err != nil {
+		return "", fmt.Errorf("could not verify token: %w", err)
+	}
+
+	if lookupPurpose(parsed.Purpose()) == nil {
+		return "", fmt.Errorf("unsupported token purpose")
+	}
+
+	err = parsed.Verify(pk, ropts.parseOpts...)
+	if err != nil {
+		return "", fmt.Errorf("could not verify token: %w", err)
+	}
+
+	return renew(parsed.Claims(), signer, ropts)
+}
+
+// Renew reissues the verified token in claims with a new ID, issue and expiry time, claims are updated in place.
+//
+// Tokens issued by the org issuer are signed again by signer, tokens issued by a chain issuer must be signed by the
+// chain issuer and its chain data is signed again by signer, their expiry is limited to that of the chain issuer.
+// Chain issuers have their chain data signed again by the org issuer, either signer or one set using WithRenewOrgIssuer
+func Renew(claims jwt.Claims, signer Signer, opts ...RenewOption) (string, error) {
+	sc, ok := claims.(Claims)
+	if !ok {
+		return "", fmt.Errorf("unsupported claims type %T", claims)
+	}
+
+	ropts, err := newRenewOpts(opts)
+	if err != nil {
+		return "", err
+	}
+
+	return renew(sc, signer, ropts)
+}
+
+func newRenewOpts(opts []RenewOption) (*renewOpts, error) {
+	ropts := &renewOpts{now: time.Now}
+	for _, opt := range opts {
+		err := opt(ropts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ropts, nil
+}
+
+func renew(claims Claims, signer Signer, opts *renewOpts) (string, error) {
+	if signer == nil {
+		return "", fmt.Errorf("signer is required")
+	}
+
+	err := claims.standardClaims().renew(signer, opts)
+	if err != nil {
+		return "", err
+	}
+
+	return SignToken(claims, signer)
+}
+
+func (c *StandardClaims) renew(signer Signer, opts *renewOpts) error {
+	validity := opts.validity
+	if validity == 0 {
+		if c.IssuedAt == nil || c.ExpiresAt == nil {
+			return fmt.Errorf("validity is required for tokens without issue or expiry times")
+		}
+
+		validity = c.ExpiresAt.Sub(c.IssuedAt.Time)
+		if validity <= 0 {
+			return fmt.Errorf("could not determine token validity")
+		}
+	}
+
+	now := jwt.NewNumericDate(opts.now().UTC())
+	chainIssued := strings.HasPrefix(c.Issuer, ChainIssuerPrefix)
+
+	if opts.chainIssuer != nil && !chainIssued {
+		return fmt.Errorf("only tokens issued by a chain issuer can be moved to another chain issuer")
+	}
+
+	if chainIssued {
+		var issuerExpires time.Time
+		switch {
+		case opts.chainIssuer != nil:
+			issuerExpires = opts.chainIssuer.ExpireTime()
+		case c.IssuerExpiresAt != nil:
+			issuerExpires = c.IssuerExpiresAt.Time
+		}
+
+		if !issuerExpires.IsZero() && !issuerExpires.After(now.Time) {
+			return fmt.Errorf("chain issuer has expired")
+		}
+	}
+
+	id, err := ksuid.NewRandomWithTime(now.Time)
+	if err != nil {
+		return err
+	}
+
+	// renew a copy so that c is only updated once renewal succeeded
+	renewed := *c
+	renewed.ID = id.String()
+	renewed.IssuedAt = now
+	renewed.NotBefore = now
+	renewed.ExpiresAt = jwt.NewNumericDate(now.Add(validity))
+
+	if opts.publicKey != nil {
+		renewed.PublicKey = hex.EncodeToString(opts.publicKey)
+	}
+
+	switch {
+	case chainIssued:
+		err = renewed.renewChainIssued(signer, opts)
+	case strings.HasPrefix(c.Issuer, OrgIssuerPrefix):
+		err = renewed.renewOrgIssued(signer, opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	*c = renewed
+
+	return nil
+}
+
+// renewOrgIssued signs the chain data of a chain issuer using the org issuer
+func (c *StandardClaims) renewOrgIssued(signer Signer, opts *renewOpts) error {
+	orgIssuer := opts.orgIssuer
+	if orgIssuer == nil {
+		orgIssuer = signer
+	}
+
+	pubK, err := signerEd25519PublicKey(orgIssuer)
+	if err != nil {
+		return fmt.Errorf("org issuer: %w", err)
+	}
+
+	if c.Issuer != OrgIssuerPrefix+hex.EncodeToString(pubK) {
+		return fmt.Errorf("signer does not match the org issuer, use WithRenewOrgIssuer")
+	}
+
+	return c.AddOrgIssuerData(orgIssuer)
+}
+
+// renewChainIssued signs the chain data of a token issued by a chain issuer using the chain issuer
+func (c *StandardClaims) renewChainIssued(signer Signer, opts *renewOpts) error {
+	if opts.chainIssuer != nil {
+		if c.ChainDelegate {
+			return c.AddChainDelegateData(opts.chainIssuer, signer)
+		}
+
+		return c.AddChainIssuerData(opts.chainIssuer, signer)
+	}
+
+	id, pubK, tcs, _, err := c.ParseChainIssuerData()
+	if err != nil {
+		return err
+	}
+
+	signerPubK, err := signerEd25519PublicKey(signer)
+	if err != nil {
+		return err
+	}
+
+	if !signerPubK.Equal(pubK) {
+		return fmt.Errorf("signer does not match the chain issuer %s", id)
+	}
+
+	var dat []byte
+	if c.ChainDelegate {
+		dat, err = c.ChainDelegateData(tcs)
+	} else {
+		dat, err = c.ChainIssuerData(tcs)
+	}
+	if err != nil {
+		return err
+	}
+
+	sig, err := signer.Sign(dat)
+	if err != nil {
+		return err
+	}
+
+	c.TrustChainSignature = fmt.Sprintf("%s.%s", tcs, hex.EncodeToString(sig))
+
+	if c.IssuerExpiresAt != nil && c.IssuerExpiresAt.Before(c.ExpiresAt.Time) {
+		c.ExpiresAt = c.IssuerExpiresAt
+	}
+
+	return nil
+}
@@ -0,0 +1,289 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	iu "github.com/choria-io/go-choria/internal/util"
+	"github.com/golang-jwt/jwt/v4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Renew", func() {
+	var (
+		orgPubK     ed25519.PublicKey
+		orgPriK     ed25519.PrivateKey
+		handler     *ClientIDClaims
+		handlerPriK ed25519.PrivateKey
+		rsaSigner   Signer
+		rsaPubK     any
+		err         error
+	)
+
+	// backdate moves the times of claims into the past while keeping the validity
+	backdate := func(c *StandardClaims, d time.Duration) {
+		c.IssuedAt = jwt.NewNumericDate(c.IssuedAt.Add(-d))
+		c.NotBefore = c.IssuedAt
+		c.ExpiresAt = jwt.NewNumericDate(c.ExpiresAt.Add(-d))
+	}
+
+	BeforeEach(func() {
+		orgPubK, orgPriK, err = iu.Ed25519KeyPair()
+		Expect(err).ToNot(HaveOccurred())
+		rsaSigner = mustSigner(loadRSAPriKey("testdata/rsa/signer-key.pem"))
+		rsaPubK = loadRSAPubKey("testdata/rsa/signer-public.pem")
+
+		handler, handlerPriK = newTestClient("choria=handler", 2*time.Hour, "rpcutil")
+		Expect(handler.AddOrgIssuerData(mustSigner(orgPriK))).To(Succeed())
+	})
+
+	It("Should renew tokens preserving their claims and validity", func() {
+		client, _ := newTestClient("up=ginkgo", time.Hour, "rpcutil")
+		client.Permissions = &ClientPermissions{ExtendedServiceLifetime: true}
+		backdate(&client.StandardClaims, 30*time.Minute)
+		id := client.ID
+
+		t, err := Renew(client, rsaSigner)
+		Expect(err).ToNot(HaveOccurred())
+
+		renewed, err := ParseClientIDToken(t, rsaPubK, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(renewed.ID).ToNot(Equal(id))
+		Expect(renewed.CallerID).To(Equal("up=ginkgo"))
+		Expect(renewed.AllowedAgents).To(Equal([]string{"rpcutil"}))
+		Expect(renewed.Permissions.ExtendedServiceLifetime).To(BeTrue())
+		Expect(renewed.ExpiresAt.Time).To(BeTemporally("~", time.Now().Add(time.Hour), time.Second))
+
+		t, err = Renew(client, rsaSigner, WithRenewValidity(2*time.Hour))
+		Expect(err).ToNot(HaveOccurred())
+		renewed, err = ParseClientIDToken(t, rsaPubK, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(renewed.ExpiresAt.Time).To(BeTemporally("~", time.Now().Add(2*time.Hour), time.Second))
+	})
+
+	It("Should rotate public keys", func() {
+		server, err := NewServerClaims("example.net", []string{"choria"}, "", nil, nil, orgPubK, "", time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+
+		newPubK, _, err := iu.Ed25519KeyPair()
+		Expect(err).ToNot(HaveOccurred())
+
+		t, err := Renew(server, rsaSigner, WithRenewPublicKey(newPubK))
+		Expect(err).ToNot(HaveOccurred())
+
+		renewed, err := ParseServerToken(t, rsaPubK)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(renewed.PublicKey).To(Equal(hex.EncodeToString(newPubK)))
+
+		_, err = Renew(server, rsaSigner, WithRenewPublicKey(ed25519.PublicKey("x")))
+		Expect(err).To(MatchError("invalid public key"))
+	})
+
+	It("Should renew tokens issued by chain issuers", func() {
+		user, _ := newTestClient("choria=user", time.Hour, "rpcutil")
+		Expect(user.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+
+		_, err := Renew(user, rsaSigner)
+		Expect(err).To(MatchError("ed25519 signer required"))
+
+		_, otherPriK := newTestClient("choria=other", time.Hour, "rpcutil")
+		_, err = Renew(user, mustSigner(otherPriK))
+		Expect(err).To(MatchError("signer does not match the chain issuer " + handler.ID))
+
+		t, err := Renew(user, mustSigner(handlerPriK), WithRenewValidity(5*time.Hour))
+		Expect(err).ToNot(HaveOccurred())
+
+		renewed, err := ParseClientIDToken(t, orgPubK, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(renewed.CallerID).To(Equal("choria=user"))
+		Expect(renewed.ExpiresAt.Unix()).To(Equal(handler.ExpiresAt.Unix()))
+	})
+
+	It("Should renew chain delegates", func() {
+		site, sitePriK := newTestClient("choria=site", time.Hour, "rpcutil")
+		Expect(site.AddChainDelegateData(handler, mustSigner(handlerPriK))).To(Succeed())
+
+		t, err := Renew(site, mustSigner(handlerPriK))
+		Expect(err).ToNot(HaveOccurred())
+		renewed, err := ParseClientIDToken(t, orgPubK, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(renewed.ChainDelegate).To(BeTrue())
+
+		user, _ := newTestClient("choria=user", time.Hour, "rpcutil")
+		Expect(user.AddChainIssuerData(renewed, mustSigner(sitePriK))).To(Succeed())
+		_, err = Renew(user, mustSigner(sitePriK))
+		Expect(err).ToNot(HaveOccurred())
+		ok, _, err := user.IsSignedByIssuer(orgPubK)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ok).To(BeTrue())
+	})
+
+	It("Should renew chain issuers", func() {
+		handler.ExpiresAt = jwt.NewNumericDate(time.Now().Add(time.Minute))
+
+		t, err := Renew(handler, mustSigner(orgPriK), WithRenewValidity(time.Hour))
+		Expect(err).ToNot(HaveOccurred())
+		renewed, err := ParseClientIDToken(t, orgPubK, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(renewed.IsChainedIssuer(true)).To(BeTrue())
+
+		_, err = Renew(handler, rsaSigner)
+		Expect(err).To(MatchError("org issuer: ed25519 signer required"))
+
+		t, err = Renew(handler, rsaSigner, WithRenewOrgIssuer(mustSigner(orgPriK)))
+		Expect(err).ToNot(HaveOccurred())
+		renewed, err = ParseClientIDToken(t, rsaPubK, true)
+		Expect(err).ToNot(HaveOccurred())
+		ok, _, err := renewed.IsSignedByIssuer(orgPubK)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ok).To(BeTrue())
+
+		_, err = Renew(handler, rsaSigner, WithRenewOrgIssuer(mustSigner(handlerPriK)))
+		Expect(err).To(MatchError("signer does not match the org issuer, use WithRenewOrgIssuer"))
+	})
+
+	It("Should move tokens to a renewed chain issuer", func() {
+		user, _ := newTestClient("choria=user", 5*time.Hour, "rpcutil")
+		Expect(user.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+		Expect(user.ExpiresAt.Time).To(Equal(handler.ExpiresAt.Time))
+
+		_, err = Renew(handler, mustSigner(orgPriK), WithRenewValidity(4*time.Hour))
+		Expect(err).ToNot(HaveOccurred())
+
+		t, err := Renew(user, mustSigner(handlerPriK), WithRenewChainIssuer(handler), WithRenewValidity(5*time.Hour))
+		Expect(err).ToNot(HaveOccurred())
+		renewed, err := ParseClientIDToken(t, orgPubK, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(renewed.ExpiresAt.Unix()).To(Equal(handler.ExpiresAt.Unix()))
+		Expect(renewed.ExpiresAt.Time).To(BeTemporally("~", time.Now().Add(4*time.Hour), time.Second))
+
+		client, _ := newTestClient("up=ginkgo", time.Hour, "rpcutil")
+		_, err = Renew(client, rsaSigner, WithRenewChainIssuer(handler))
+		Expect(err).To(MatchError("only tokens issued by a chain issuer can be moved to another chain issuer"))
+	})
+
+	It("Should refuse to renew tokens of expired chain issuers", func() {
+		user, _ := newTestClient("choria=user", time.Hour, "rpcutil")
+		Expect(user.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+		user.IssuerExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+
+		id := user.ID
+		expires := user.ExpiresAt.Time
+
+		_, err := Renew(user, mustSigner(handlerPriK))
+		Expect(err).To(MatchError("chain issuer has expired"))
+		Expect(user.ID).To(Equal(id))
+		Expect(user.ExpiresAt.Time).To(Equal(expires))
+
+		renewed, _ := newTestClient("choria=handler", time.Hour, "rpcutil")
+		renewed.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+		user.IssuerExpiresAt = jwt.NewNumericDate(time.Now().Add(time.Hour))
+		_, err = Renew(user, mustSigner(handlerPriK), WithRenewChainIssuer(renewed))
+		Expect(err).To(MatchError("chain issuer has expired"))
+		Expect(user.ID).To(Equal(id))
+	})
+
+	It("Should not change tokens that fail to renew", func() {
+		id := handler.ID
+
+		_, err := Renew(handler, rsaSigner, WithRenewOrgIssuer(mustSigner(handlerPriK)))
+		Expect(err).To(MatchError("signer does not match the org issuer, use WithRenewOrgIssuer"))
+		Expect(handler.ID).To(Equal(id))
+		Expect(handler.IsChainedIssuer(true)).To(BeTrue())
+	})
+
+	Describe("RenewToken", func() {
+		It("Should verify and renew the token", func() {
+			server, err := NewServerClaims("example.net", []string{"choria"}, "", nil, nil, orgPubK, "", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			t, err := SignToken(server, rsaSigner)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = RenewToken(t, loadRSAPubKey("testdata/rsa/other-public.pem"), rsaSigner)
+			Expect(err).To(MatchError("could not verify token: could not parse choria_server token: crypto/rsa: verification error"))
+
+			t, err = RenewToken(t, rsaPubK, rsaSigner)
+			Expect(err).ToNot(HaveOccurred())
+			renewed, err := ParseServerToken(t, rsaPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(renewed.ChoriaIdentity).To(Equal("example.net"))
+			Expect(renewed.ID).ToNot(Equal(server.ID))
+
+			_, err = RenewToken("x", rsaPubK, rsaSigner)
+			Expect(err).To(MatchError("could not verify token: token contains an invalid number of segments"))
+
+			std, err := newStandardClaims("", "ginkgo_unknown", time.Hour, false)
+			Expect(err).ToNot(HaveOccurred())
+			t, err = SignToken(std, rsaSigner)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = RenewToken(t, rsaPubK, rsaSigner)
+			Expect(err).To(MatchError("unsupported token purpose"))
+		})
+
+		It("Should verify using the parse options", func() {
+			server, err := NewServerClaims("example.net", []string{"choria"}, "", nil, nil, orgPubK, "", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			t, err := SignToken(server, rsaSigner)
+			Expect(err).ToNot(HaveOccurred())
+
+			list, err := NewRevocationListClaims("", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(list.RevokeToken(server.ID)).To(Succeed())
+
+			_, err = RenewToken(t, rsaPubK, rsaSigner, WithRenewParseOptions(WithRevocations(list)))
+			Expect(errors.Is(err, ErrRevoked)).To(BeTrue())
+
+			_, err = RenewWithSigner(rsaPubK, rsaSigner, WithRenewParseOptions(WithRevocations(list)))(context.Background(), t)
+			Expect(errors.Is(err, ErrRevoked)).To(BeTrue())
+
+			// the handler is issued by the old org issuer and verified using the key of the new one
+			newPubK, newPriK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			endorsements, err := CrossSignIssuers(mustSigner(orgPriK), mustSigner(newPriK), time.Now().Add(-time.Minute), time.Now().Add(time.Hour))
+			Expect(err).ToNot(HaveOccurred())
+
+			t, err = SignToken(handler, mustSigner(orgPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = RenewToken(t, newPubK, mustSigner(orgPriK))
+			Expect(err).To(HaveOccurred())
+
+			t, err = RenewToken(t, newPubK, mustSigner(orgPriK), WithRenewParseOptions(WithIssuerEndorsements(endorsements...)))
+			Expect(err).ToNot(HaveOccurred())
+			renewed, err := ParseClientIDToken(t, orgPubK, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(renewed.ID).ToNot(Equal(handler.ID))
+		})
+
+		It("Should renew registered purposes and run their checks", func() {
+			registerTestAgentPurpose()
+
+			std, err := newStandardClaims("", testAgentPurpose, time.Hour, false)
+			Expect(err).ToNot(HaveOccurred())
+			agent := &testAgentClaims{Agent: "rpcutil", StandardClaims: *std}
+			t, err := SignToken(agent, rsaSigner)
+			Expect(err).ToNot(HaveOccurred())
+
+			t, err = RenewToken(t, rsaPubK, rsaSigner)
+			Expect(err).ToNot(HaveOccurred())
+			renewed, err := ParseAny(t, rsaPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(renewed.(*testAgentClaims).Agent).To(Equal("rpcutil"))
+			Expect(renewed.(*testAgentClaims).ID).ToNot(Equal(agent.ID))
+
+			agent.Agent = ""
+			t, err = SignToken(agent, rsaSigner)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = RenewToken(t, rsaPubK, rsaSigner)
+			Expect(err).To(MatchError("could not verify token: agent is required"))
+		})
+	})
+})
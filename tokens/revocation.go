@@ -0,0 +1,195 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// RevocationListClaims is a list of revoked tokens, public keys and chain issuers signed by the org issuer
+type RevocationListClaims struct {
+	// Tokens are the IDs of revoked tokens
+	Tokens []string `json:"tokens,omitempty"`
+
+	// PublicKeys are hex encoded ed25519 public keys, any token holding or issued by these keys are revoked
+	PublicKeys []string `json:"public_keys,omitempty"`
+
+	// ChainIssuers are the IDs of revoked chain issuers, tokens issued by these are revoked
+	ChainIssuers []string `json:"chain_issuers,omitempty"`
+
+	StandardClaims
+}
+
+// ErrNotARevocationList indicates a token is not a revocation list
+var ErrNotARevocationList error = newVerificationError(ErrWrongPurpose, nil, "not a revocation list")
+
+// NewRevocationListClaims generates a new empty RevocationListClaims
+func NewRevocationListClaims(issuer string, validity time.Duration) (*RevocationListClaims, error) {
+	stdClaims, err := newStandardClaims(issuer, RevocationListPurpose, validity, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RevocationListClaims{StandardClaims: *stdClaims}, nil
+}
+
+// RevokeToken adds the token with id to the revocation list
+func (r *RevocationListClaims) RevokeToken(id string) error {
+	if id == "" {
+		return fmt.Errorf("id is required")
+	}
+
+	if !stringInList(r.Tokens, id) {
+		r.Tokens = append(r.Tokens, id)
+	}
+
+	return nil
+}
+
+// RevokePublicKey adds pk to the revocation list
+func (r *RevocationListClaims) RevokePublicKey(pk ed25519.PublicKey) error {
+	if len(pk) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid public key")
+	}
+
+	hpk := hex.EncodeToString(pk)
+	if !stringInList(r.PublicKeys, hpk) {
+		r.PublicKeys = append(r.PublicKeys, hpk)
+	}
+
+	return nil
+}
+
+// RevokeChainIssuer adds the chain issuer with id to the revocation list, the chain issuer token itself and all tokens it issued are revoked
+func (r *RevocationListClaims) RevokeChainIssuer(id string) error {
+	if id == "" {
+		return fmt.Errorf("id is required")
+	}
+
+	if !stringInList(r.ChainIssuers, id) {
+		r.ChainIssuers = append(r.ChainIssuers, id)
+	}
+
+	return nil
+}
+
+// checkCurrent ensures the list has not expired at now, an expired list can not be trusted to be complete
+func (r *RevocationListClaims) checkCurrent(now time.Time) error {
+	if r.ExpiresAt != nil && now.After(r.ExpiresAt.Time) {
+		return newVerificationError(ErrRevocationListExpired, nil, "revocation list %s has expired", r.ID)
+	}
+
+	return nil
+}
+
+// CheckRevoked checks claims against the revocation list, returns an error matching ErrRevoked when any of the
+// token ID, its public key or its chain issuer are revoked
+func (r *RevocationListClaims) CheckRevoked(claims *StandardClaims) error {
+	if claims.ID != "" && stringInList(r.Tokens, claims.ID) {
+		return newVerificationError(ErrRevoked, nil, "token %s has been revoked", claims.ID)
+	}
+
+	if claims.PublicKey != "" && stringInList(r.PublicKeys, claims.PublicKey) {
+		return newVerificationError(ErrRevoked, nil, "public key %s has been revoked", claims.PublicKey)
+	}
+
+	switch {
+	case strings.HasPrefix(claims.Issuer, OrgIssuerPrefix):
+		// chain issuers are issued by the org issuer, they can be revoked by their own id
+		return r.checkChainIssuer(claims.ID, claims.PublicKey)
+
+	case strings.HasPrefix(claims.Issuer, ChainIssuerPrefix):
+		issuers, err := claims.ChainIssuers()
+		if err != nil {
+			return err
+		}
+
+		for _, ci := range issuers {
+			err = r.checkChainIssuer(ci.ID, ci.PublicKey)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkChainIssuer checks if the chain issuer with id and hex encoded public key pk is revoked
+func (r *RevocationListClaims) checkChainIssuer(id string, pk string) error {
+	if id != "" && stringInList(r.ChainIssuers, id) {
+		return newVerificationError(ErrRevoked, nil, "chain issuer %s has been revoked", id)
+	}
+
+	if pk != "" && stringInList(r.PublicKeys, pk) {
+		return newVerificationError(ErrRevoked, nil, "chain issuer public key %s has been revoked", pk)
+	}
+
+	return nil
+}
+
+// IsRevocationListToken determines if this is a revocation list token
+func IsRevocationListToken(claims StandardClaims) bool {
+	return claims.Purpose == RevocationListPurpose
+}
+
+// ParseRevocationList parses token and verifies it with pk, pk should be the public key of the org issuer
+func ParseRevocationList(token string, pk any) (*RevocationListClaims, error) {
+	claims := &RevocationListClaims{}
+	err := ParseToken(token, claims, pk)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse revocation list: %w", err)
+	}
+
+	if !IsRevocationListToken(claims.StandardClaims) {
+		return nil, ErrNotARevocationList
+	}
+
+	return claims, nil
+}
+
+// ParseRevocationListWithKeyfile parses token and verifies it with the RSA, ECDSA or ed25519 public key in pkFile
+func ParseRevocationListWithKeyfile(token string, pkFile string) (*RevocationListClaims, error) {
+	if pkFile == "" {
+		return nil, fmt.Errorf("invalid public key file")
+	}
+
+	certdat, err := os.ReadFile(pkFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read validation certificate: %s", err)
+	}
+
+	pk, err := readPublicKeyData(certdat)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseRevocationList(token, pk)
+}
+
+// ParseRevocationListFile reads a revocation list from file and verifies it with pk
+func ParseRevocationListFile(file string, pk any) (*RevocationListClaims, error) {
+	dat, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseRevocationList(strings.TrimSpace(string(dat)), pk)
+}
+
+func stringInList(list []string, s string) bool {
+	for _, i := range list {
+		if i == s {
+			return true
+		}
+	}
+
+	return false
+}
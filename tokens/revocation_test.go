@@ -0,0 +1,280 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	iu "github.com/choria-io/go-choria/internal/util"
+	"github.com/golang-jwt/jwt/v4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RevocationListClaims", func() {
+	var (
+		orgPubK     ed25519.PublicKey
+		orgPriK     ed25519.PrivateKey
+		handler     *ClientIDClaims
+		handlerPubK ed25519.PublicKey
+		handlerPriK ed25519.PrivateKey
+		user        *ClientIDClaims
+		userPubK    ed25519.PublicKey
+		list        *RevocationListClaims
+		err         error
+	)
+
+	BeforeEach(func() {
+		orgPubK, orgPriK, err = iu.Ed25519KeyPair()
+		Expect(err).ToNot(HaveOccurred())
+		handlerPubK, handlerPriK, err = iu.Ed25519KeyPair()
+		Expect(err).ToNot(HaveOccurred())
+		userPubK, _, err = iu.Ed25519KeyPair()
+		Expect(err).ToNot(HaveOccurred())
+
+		handler, err = NewClientIDClaims("choria=handler", nil, "", nil, "", "", time.Hour, nil, handlerPubK)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(handler.AddOrgIssuerData(mustSigner(orgPriK))).To(Succeed())
+
+		user, err = NewClientIDClaims("choria=user", nil, "", nil, "", "", time.Hour, nil, userPubK)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(user.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+
+		list, err = NewRevocationListClaims("", time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Describe("NewRevocationListClaims", func() {
+		It("Should create an empty list", func() {
+			Expect(list.Purpose).To(Equal(RevocationListPurpose))
+			Expect(list.ExpiresAt.Time).To(BeTemporally("~", time.Now().Add(time.Hour), time.Second))
+			Expect(list.CheckRevoked(&user.StandardClaims)).To(Succeed())
+		})
+	})
+
+	Describe("Revoke", func() {
+		It("Should validate and deduplicate entries", func() {
+			Expect(list.RevokeToken("")).To(MatchError("id is required"))
+			Expect(list.RevokeChainIssuer("")).To(MatchError("id is required"))
+			Expect(list.RevokePublicKey(ed25519.PublicKey("x"))).To(MatchError("invalid public key"))
+
+			Expect(list.RevokeToken("x")).To(Succeed())
+			Expect(list.RevokeToken("x")).To(Succeed())
+			Expect(list.RevokePublicKey(userPubK)).To(Succeed())
+			Expect(list.RevokePublicKey(userPubK)).To(Succeed())
+			Expect(list.RevokeChainIssuer("y")).To(Succeed())
+			Expect(list.RevokeChainIssuer("y")).To(Succeed())
+
+			Expect(list.Tokens).To(Equal([]string{"x"}))
+			Expect(list.PublicKeys).To(Equal([]string{hex.EncodeToString(userPubK)}))
+			Expect(list.ChainIssuers).To(Equal([]string{"y"}))
+		})
+	})
+
+	Describe("CheckRevoked", func() {
+		It("Should detect revoked tokens", func() {
+			Expect(list.RevokeToken(user.ID)).To(Succeed())
+			err := list.CheckRevoked(&user.StandardClaims)
+			Expect(err).To(MatchError("token " + user.ID + " has been revoked"))
+			Expect(errors.Is(err, ErrRevoked)).To(BeTrue())
+			Expect(list.CheckRevoked(&handler.StandardClaims)).To(Succeed())
+		})
+
+		It("Should detect revoked public keys", func() {
+			Expect(list.RevokePublicKey(userPubK)).To(Succeed())
+			err := list.CheckRevoked(&user.StandardClaims)
+			Expect(err).To(MatchError("public key " + user.PublicKey + " has been revoked"))
+			Expect(errors.Is(err, ErrRevoked)).To(BeTrue())
+			Expect(list.CheckRevoked(&handler.StandardClaims)).To(Succeed())
+		})
+
+		It("Should detect revoked chain issuers", func() {
+			Expect(list.RevokeChainIssuer(handler.ID)).To(Succeed())
+			Expect(list.CheckRevoked(&handler.StandardClaims)).To(MatchError("chain issuer " + handler.ID + " has been revoked"))
+
+			err := list.CheckRevoked(&user.StandardClaims)
+			Expect(err).To(MatchError("chain issuer " + handler.ID + " has been revoked"))
+			Expect(errors.Is(err, ErrRevoked)).To(BeTrue())
+		})
+
+		It("Should detect revoked chain issuer public keys", func() {
+			Expect(list.RevokePublicKey(handlerPubK)).To(Succeed())
+			Expect(list.CheckRevoked(&handler.StandardClaims)).To(MatchError("public key " + handler.PublicKey + " has been revoked"))
+			Expect(list.CheckRevoked(&user.StandardClaims)).To(MatchError("chain issuer public key " + handler.PublicKey + " has been revoked"))
+		})
+	})
+
+	Describe("ParseRevocationList", func() {
+		It("Should parse and verify the list", func() {
+			Expect(list.RevokeToken("x")).To(Succeed())
+			t, err := SignToken(list, mustSigner(orgPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			parsed, err := ParseRevocationList(t, orgPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed.Tokens).To(Equal([]string{"x"}))
+
+			_, err = ParseRevocationList(t, handlerPubK)
+			Expect(err).To(MatchError("could not parse revocation list: ed25519: verification error"))
+		})
+
+		It("Should detect expired lists", func() {
+			list.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+			t, err := SignToken(list, mustSigner(orgPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseRevocationList(t, orgPubK)
+			Expect(errors.Is(err, jwt.ErrTokenExpired)).To(BeTrue())
+		})
+
+		It("Should detect other tokens", func() {
+			t, err := SignToken(handler, mustSigner(orgPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseRevocationList(t, orgPubK)
+			Expect(err).To(MatchError(ErrNotARevocationList))
+			Expect(errors.Is(err, ErrWrongPurpose)).To(BeTrue())
+		})
+
+		It("Should parse lists from files", func() {
+			t, err := SignTokenWithKeyFile(list, "testdata/rsa/signer-key.pem")
+			Expect(err).ToNot(HaveOccurred())
+
+			tf := filepath.Join(GinkgoT().TempDir(), "revocations.jwt")
+			Expect(os.WriteFile(tf, []byte(t+"\n"), 0600)).To(Succeed())
+
+			parsed, err := ParseRevocationListFile(tf, loadRSAPubKey("testdata/rsa/signer-public.pem"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed.ID).To(Equal(list.ID))
+
+			parsed, err = ParseRevocationListWithKeyfile(t, "testdata/rsa/signer-public.pem")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed.ID).To(Equal(list.ID))
+		})
+	})
+
+	Describe("Chain issuer revocation", func() {
+		It("Should reject chain issuers revoked by id in IsSignedByIssuer", func() {
+			Expect(list.RevokeChainIssuer(handler.ID)).To(Succeed())
+
+			ok, _, err := handler.IsSignedByIssuer(orgPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+
+			ok, _, err = handler.IsSignedByIssuer(orgPubK, WithRevocations(list))
+			Expect(err).To(MatchError("chain issuer " + handler.ID + " has been revoked"))
+			Expect(ok).To(BeFalse())
+
+			ok, _, err = user.IsSignedByIssuer(orgPubK, WithRevocations(list))
+			Expect(err).To(MatchError("chain issuer " + handler.ID + " has been revoked"))
+			Expect(errors.Is(err, ErrRevoked)).To(BeTrue())
+			Expect(ok).To(BeFalse())
+		})
+
+		It("Should reject chain issuers revoked by public key in IsSignedByIssuer", func() {
+			Expect(list.RevokePublicKey(handlerPubK)).To(Succeed())
+
+			ok, _, err := user.IsSignedByIssuer(orgPubK, WithRevocations(list))
+			Expect(err).To(MatchError("chain issuer public key " + handler.PublicKey + " has been revoked"))
+			Expect(ok).To(BeFalse())
+		})
+
+		It("Should reject client tokens issued by revoked chain issuers", func() {
+			t, err := SignToken(user, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseClientIDToken(t, orgPubK, true, WithRevocations(list))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(list.RevokeChainIssuer(handler.ID)).To(Succeed())
+
+			_, err = ParseClientIDToken(t, orgPubK, true, WithRevocations(list))
+			Expect(err).To(MatchError("could not parse client id token: not signed by issuer: chain issuer " + handler.ID + " has been revoked"))
+			Expect(errors.Is(err, ErrRevoked)).To(BeTrue())
+
+			kr, err := NewKeyring(orgPubK)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = ParseClientIDToken(t, kr, true, WithRevocations(list))
+			Expect(errors.Is(err, ErrRevoked)).To(BeTrue())
+		})
+
+		It("Should reject server tokens issued by revoked chain issuers", func() {
+			serverPubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			server, err := NewServerClaims("example.net", []string{"choria"}, "", nil, nil, serverPubK, "", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+
+			t, err := SignToken(server, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseServerToken(t, orgPubK, WithRevocations(list))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(list.RevokePublicKey(handlerPubK)).To(Succeed())
+
+			_, err = ParseServerToken(t, orgPubK, WithRevocations(list))
+			Expect(err).To(MatchError("could not parse server id token: not signed by issuer: chain issuer public key " + handler.PublicKey + " has been revoked"))
+			Expect(errors.Is(err, ErrRevoked)).To(BeTrue())
+		})
+
+		It("Should reject revoked chain issuer tokens", func() {
+			t, err := SignToken(handler, mustSigner(orgPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(list.RevokeChainIssuer(handler.ID)).To(Succeed())
+
+			_, err = ParseClientIDToken(t, orgPubK, true, WithRevocations(list))
+			Expect(err).To(MatchError("could not parse client id token: chain issuer " + handler.ID + " has been revoked"))
+
+			_, err = ParseClientIDToken(t, orgPubK, true)
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Describe("Verifier", func() {
+		It("Should reject revoked tokens", func() {
+			v, err := NewVerifier(WithTrustedKeys(orgPubK), WithRevocationList(list))
+			Expect(err).ToNot(HaveOccurred())
+
+			t, err := SignToken(user, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = v.VerifyClient(t)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(list.RevokeChainIssuer(handler.ID)).To(Succeed())
+			_, err = v.VerifyClient(t)
+			Expect(err).To(MatchError("could not parse client id token: chain issuer " + handler.ID + " has been revoked"))
+			Expect(errors.Is(err, ErrRevoked)).To(BeTrue())
+
+			v.SetRevocationList(nil)
+			_, err = v.VerifyClient(t)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should reject all tokens when the list expired", func() {
+			list.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+			v, err := NewVerifier(WithTrustedKeys(orgPubK), WithRevocationList(list))
+			Expect(err).ToNot(HaveOccurred())
+
+			t, err := SignToken(user, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = v.VerifyClient(t)
+			Expect(err).To(MatchError("could not parse client id token: revocation list " + list.ID + " has expired"))
+			Expect(errors.Is(err, ErrRevocationListExpired)).To(BeTrue())
+
+			_, err = ParseClientIDToken(t, orgPubK, true, WithRevocations(list))
+			Expect(err).To(MatchError("could not parse client id token: revocation list " + list.ID + " has expired"))
+			Expect(errors.Is(err, ErrRevocationListExpired)).To(BeTrue())
+		})
+	})
+})
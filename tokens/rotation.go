@@ -0,0 +1,186 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	iu "github.com/choria-io/go-choria/internal/util"
+)
+
+// IssuerEndorsement is a statement by an org issuer that it trusts another org issuer for a period of time, used
+// to rotate org issuers without invalidating existing chain issuers.
+//
+// During a rotation the old and new org issuers endorse each other, see CrossSignIssuers, and verifiers holding
+// either key accept tokens and trust chains rooted in the other while the endorsement is valid
+type IssuerEndorsement struct {
+	// Issuer is the hex encoded ed25519 public key of the endorsing org issuer
+	Issuer string `json:"issuer"`
+
+	// Subject is the hex encoded ed25519 public key of the endorsed org issuer
+	Subject string `json:"subject"`
+
+	// NotBefore is the time the endorsement becomes valid
+	NotBefore time.Time `json:"not_before"`
+
+	// NotAfter is the time the endorsement stops being valid
+	NotAfter time.Time `json:"not_after"`
+
+	// Signature is the hex encoded signature made by the Issuer
+	Signature string `json:"signature"`
+}
+
+// NewIssuerEndorsement creates an endorsement of subject signed by the org issuer signer, valid between notBefore and notAfter
+func NewIssuerEndorsement(signer Signer, subject ed25519.PublicKey, notBefore time.Time, notAfter time.Time) (*IssuerEndorsement, error) {
+	pubK, err := signerEd25519PublicKey(signer)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(subject) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid subject public key")
+	}
+
+	if !notAfter.After(notBefore) {
+		return nil, fmt.Errorf("endorsement is never valid")
+	}
+
+	if pubK.Equal(subject) {
+		return nil, fmt.Errorf("an issuer can not endorse itself")
+	}
+
+	e := &IssuerEndorsement{
+		Issuer:    hex.EncodeToString(pubK),
+		Subject:   hex.EncodeToString(subject),
+		NotBefore: notBefore.UTC().Truncate(time.Second),
+		NotAfter:  notAfter.UTC().Truncate(time.Second),
+	}
+
+	sig, err := signer.Sign(e.signedData())
+	if err != nil {
+		return nil, err
+	}
+
+	e.Signature = hex.EncodeToString(sig)
+
+	return e, nil
+}
+
+// CrossSignIssuers creates endorsements of the new org issuer by the old one and of the old org issuer by the new one
+func CrossSignIssuers(oldSigner Signer, newSigner Signer, notBefore time.Time, notAfter time.Time) ([]*IssuerEndorsement, error) {
+	oldPubK, err := signerEd25519PublicKey(oldSigner)
+	if err != nil {
+		return nil, err
+	}
+
+	newPubK, err := signerEd25519PublicKey(newSigner)
+	if err != nil {
+		return nil, err
+	}
+
+	forward, err := NewIssuerEndorsement(oldSigner, newPubK, notBefore, notAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	backward, err := NewIssuerEndorsement(newSigner, oldPubK, notBefore, notAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*IssuerEndorsement{forward, backward}, nil
+}
+
+// ParseIssuerEndorsementsFile reads a JSON encoded list of endorsements from file, their signatures are checked when used
+func ParseIssuerEndorsementsFile(file string) ([]*IssuerEndorsement, error) {
+	dat, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var endorsements []*IssuerEndorsement
+	err = json.Unmarshal(dat, &endorsements)
+	if err != nil {
+		return nil, fmt.Errorf("invalid issuer endorsements: %w", err)
+	}
+
+	return endorsements, nil
+}
+
+// WithIssuerEndorsements accepts tokens and trust chains rooted in org issuers endorsed by the org issuer being verified against
+func WithIssuerEndorsements(endorsements ...*IssuerEndorsement) ParseOption {
+	return func(o *parseOpts) {
+		o.endorsements = append(o.endorsements, endorsements...)
+	}
+}
+
+// Verify checks the signature of the endorsement and that it is valid at time t
+func (e *IssuerEndorsement) Verify(t time.Time) error {
+	issuer, err := hex.DecodeString(e.Issuer)
+	if err != nil || len(issuer) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid issuer public key in endorsement")
+	}
+
+	sig, err := hex.DecodeString(e.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature in endorsement")
+	}
+
+	ok, err := iu.Ed25519Verify(issuer, e.signedData(), sig)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return newVerificationError(ErrChainSignatureInvalid, nil, "invalid endorsement signature")
+	}
+
+	if t.Before(e.NotBefore) || !t.Before(e.NotAfter) {
+		return newVerificationError(ErrIssuerExpired, nil, "endorsement of %s is not valid at %s", e.Subject, t.UTC().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+func (e *IssuerEndorsement) signedData() []byte {
+	return []byte(fmt.Sprintf("endorse.%s.%s.%d.%d", e.Issuer, e.Subject, e.NotBefore.Unix(), e.NotAfter.Unix()))
+}
+
+// rootKeys are the org issuer keys trust chains may be rooted in when verifying against pk, pk followed by every org
+// issuer validly endorsed by pk
+func (o *parseOpts) rootKeys(pk ed25519.PublicKey) []ed25519.PublicKey {
+	keys := []ed25519.PublicKey{pk}
+	issuer := hex.EncodeToString(pk)
+
+	for _, e := range o.endorsements {
+		if e == nil || e.Issuer != issuer || e.Verify(o.now()) != nil {
+			continue
+		}
+
+		subject, err := hex.DecodeString(e.Subject)
+		if err != nil || len(subject) != ed25519.PublicKeySize {
+			continue
+		}
+
+		keys = append(keys, subject)
+	}
+
+	return keys
+}
+
+// orgIssuerKey finds the key of the org issuer of a token issued by an org issuer, either pk or an org issuer endorsed by pk
+func (o *parseOpts) orgIssuerKey(pk ed25519.PublicKey, issuer string) (ed25519.PublicKey, bool) {
+	for _, key := range o.rootKeys(pk) {
+		if issuer == OrgIssuerPrefix+hex.EncodeToString(key) {
+			return key, true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	iu "github.com/choria-io/go-choria/internal/util"
+	"github.com/golang-jwt/jwt/v4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Org issuer rotation", func() {
+	var (
+		oldPubK      ed25519.PublicKey
+		oldPriK      ed25519.PrivateKey
+		newPubK      ed25519.PublicKey
+		newPriK      ed25519.PrivateKey
+		endorsements []*IssuerEndorsement
+		notBefore    time.Time
+		notAfter     time.Time
+		err          error
+	)
+
+	// issueChain creates a chain issuer signed by the org issuer priK and a user issued by it
+	issueChain := func(priK ed25519.PrivateKey) (string, string) {
+		handlerPubK, handlerPriK, err := iu.Ed25519KeyPair()
+		Expect(err).ToNot(HaveOccurred())
+		handler, err := NewClientIDClaims("choria=login", nil, "", nil, "", "", time.Hour, nil, handlerPubK)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(handler.AddOrgIssuerData(mustSigner(priK))).To(Succeed())
+
+		userPubK, _, err := iu.Ed25519KeyPair()
+		Expect(err).ToNot(HaveOccurred())
+		user, err := NewClientIDClaims("choria=user", nil, "", nil, "", "", time.Hour, nil, userPubK)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(user.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+
+		handlerToken, err := SignToken(handler, mustSigner(priK))
+		Expect(err).ToNot(HaveOccurred())
+		userToken, err := SignToken(user, mustSigner(handlerPriK))
+		Expect(err).ToNot(HaveOccurred())
+
+		return handlerToken, userToken
+	}
+
+	BeforeEach(func() {
+		oldPubK, oldPriK, err = iu.Ed25519KeyPair()
+		Expect(err).ToNot(HaveOccurred())
+		newPubK, newPriK, err = iu.Ed25519KeyPair()
+		Expect(err).ToNot(HaveOccurred())
+
+		notBefore = time.Now().Add(-time.Hour)
+		notAfter = time.Now().Add(time.Hour)
+		endorsements, err = CrossSignIssuers(mustSigner(oldPriK), mustSigner(newPriK), notBefore, notAfter)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Describe("NewIssuerEndorsement", func() {
+		It("Should validate the endorsement", func() {
+			_, err := NewIssuerEndorsement(mustSigner(loadRSAPriKey("testdata/rsa/signer-key.pem")), newPubK, notBefore, notAfter)
+			Expect(err).To(MatchError("ed25519 signer required"))
+
+			_, err = NewIssuerEndorsement(mustSigner(oldPriK), ed25519.PublicKey("x"), notBefore, notAfter)
+			Expect(err).To(MatchError("invalid subject public key"))
+
+			_, err = NewIssuerEndorsement(mustSigner(oldPriK), newPubK, notAfter, notBefore)
+			Expect(err).To(MatchError("endorsement is never valid"))
+
+			_, err = NewIssuerEndorsement(mustSigner(oldPriK), oldPubK, notBefore, notAfter)
+			Expect(err).To(MatchError("an issuer can not endorse itself"))
+		})
+
+		It("Should create verifiable endorsements", func() {
+			Expect(endorsements).To(HaveLen(2))
+			Expect(endorsements[0].Issuer).To(Equal(hex.EncodeToString(oldPubK)))
+			Expect(endorsements[0].Subject).To(Equal(hex.EncodeToString(newPubK)))
+			Expect(endorsements[1].Issuer).To(Equal(hex.EncodeToString(newPubK)))
+			Expect(endorsements[1].Subject).To(Equal(hex.EncodeToString(oldPubK)))
+
+			for _, e := range endorsements {
+				Expect(e.Verify(time.Now())).To(Succeed())
+			}
+
+			err := endorsements[0].Verify(notAfter.Add(time.Second))
+			Expect(errors.Is(err, ErrIssuerExpired)).To(BeTrue())
+			Expect(errors.Is(endorsements[0].Verify(notBefore.Add(-time.Minute)), ErrIssuerExpired)).To(BeTrue())
+
+			endorsements[0].NotAfter = endorsements[0].NotAfter.Add(time.Hour)
+			Expect(endorsements[0].Verify(time.Now())).To(MatchError("invalid endorsement signature"))
+		})
+	})
+
+	Describe("ParseIssuerEndorsementsFile", func() {
+		It("Should read endorsements", func() {
+			file := filepath.Join(GinkgoT().TempDir(), "endorsements.json")
+			dat, err := json.Marshal(endorsements)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.WriteFile(file, dat, 0600)).To(Succeed())
+
+			loaded, err := ParseIssuerEndorsementsFile(file)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(loaded).To(HaveLen(2))
+			for _, e := range loaded {
+				Expect(e.Verify(time.Now())).To(Succeed())
+			}
+		})
+	})
+
+	Describe("Verification", func() {
+		It("Should accept chains rooted in either issuer during the overlap", func() {
+			oldHandler, oldUser := issueChain(oldPriK)
+			newHandler, newUser := issueChain(newPriK)
+
+			for _, t := range []string{oldHandler, oldUser, newHandler, newUser} {
+				_, err := ParseClientIDToken(t, newPubK, true, WithIssuerEndorsements(endorsements...))
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = ParseClientIDToken(t, oldPubK, true, WithIssuerEndorsements(endorsements...))
+				Expect(err).ToNot(HaveOccurred())
+			}
+		})
+
+		It("Should require endorsements", func() {
+			oldHandler, oldUser := issueChain(oldPriK)
+
+			_, err := ParseClientIDToken(oldHandler, newPubK, true)
+			Expect(err).To(HaveOccurred())
+
+			_, err = ParseClientIDToken(oldUser, newPubK, true)
+			Expect(err).To(MatchError("could not parse client id token: not signed by issuer: invalid org issuer signature for chain issuer " + mustParseUnverifiedChainIssuerID(oldUser)))
+
+			// the new issuer must endorse the old one for it to be trusted by holders of the new key
+			_, err = ParseClientIDToken(oldUser, newPubK, true, WithIssuerEndorsements(endorsements[0]))
+			Expect(errors.Is(err, ErrChainSignatureInvalid)).To(BeTrue())
+
+			other, err := NewIssuerEndorsement(mustSigner(oldPriK), newPubK, notBefore, notAfter)
+			Expect(err).ToNot(HaveOccurred())
+			other.Issuer, other.Subject = other.Subject, other.Issuer
+			_, err = ParseClientIDToken(oldUser, newPubK, true, WithIssuerEndorsements(other))
+			Expect(errors.Is(err, ErrChainSignatureInvalid)).To(BeTrue())
+
+			ok, _, err := (&StandardClaims{}).IsSignedByIssuer(newPubK, WithIssuerEndorsements(endorsements...))
+			Expect(err).To(MatchError("no issuer set"))
+			Expect(ok).To(BeFalse())
+		})
+
+		It("Should only accept endorsements during their validity", func() {
+			_, oldUser := issueChain(oldPriK)
+
+			v, err := NewVerifier(WithTrustedKeys(newPubK), WithParseOptions(WithIssuerEndorsements(endorsements...)))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = v.VerifyClient(oldUser)
+			Expect(err).ToNot(HaveOccurred())
+
+			v, err = NewVerifier(WithTrustedKeys(newPubK), WithParseOptions(WithIssuerEndorsements(endorsements...)), WithClock(func() time.Time { return notAfter.Add(time.Minute) }), WithLeeway(time.Hour))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = v.VerifyClient(oldUser)
+			Expect(errors.Is(err, ErrChainSignatureInvalid)).To(BeTrue())
+		})
+	})
+})
+
+func mustParseUnverifiedChainIssuerID(token string) string {
+	claims := &ClientIDClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(token, claims)
+	Expect(err).ToNot(HaveOccurred())
+
+	issuers, err := claims.ChainIssuers()
+	Expect(err).ToNot(HaveOccurred())
+
+	return issuers[0].ID
+}
@@ -5,7 +5,6 @@
 package tokens
 
 import (
-	"bytes"
 	"crypto/ed25519"
 	"crypto/md5"
 	"encoding/hex"
@@ -51,8 +50,8 @@ type ServerClaims struct {
 }
 
 var (
-	ErrNotAServerToken  = errors.New("not a server token")
-	ErrChainIssuerToken = errors.New("chain issuers may not access servers")
+	ErrNotAServerToken  error = newVerificationError(ErrWrongPurpose, nil, "not a server token")
+	ErrChainIssuerToken       = errors.New("chain issuers may not access servers")
 )
 
 // UniqueID returns the identity and unique id used to generate private inboxes
@@ -60,49 +59,6 @@ func (c *ServerClaims) UniqueID() (id string, uid string) {
 	return c.ChoriaIdentity, fmt.Sprintf("%x", md5.Sum([]byte(c.ChoriaIdentity)))
 }
 
-// IsMatchingPublicKey checks that the stored public key matches the supplied one
-func (c *ServerClaims) IsMatchingPublicKey(pubK ed25519.PublicKey) (bool, error) {
-	if c.PublicKey == "" {
-		return false, fmt.Errorf("no public key stored in the JWT")
-	}
-
-	if len(pubK) != ed25519.PublicKeySize {
-		return false, fmt.Errorf("invalid size for public key")
-	}
-
-	jpubK, err := hex.DecodeString(c.PublicKey)
-	if err != nil {
-		return false, err
-	}
-
-	if len(jpubK) != ed25519.PublicKeySize {
-		return false, fmt.Errorf("invalid size for token stored public key")
-	}
-
-	return bytes.Equal(jpubK, pubK), nil
-}
-
-// IsMatchingSeedFile determines if the token public key matches the seed in file
-func (c *ServerClaims) IsMatchingSeedFile(file string) (bool, error) {
-	sb, err := os.ReadFile(file)
-	if err != nil {
-		return false, err
-	}
-
-	seed, err := hex.DecodeString(string(sb))
-	if err != nil {
-		return false, err
-	}
-
-	if len(seed) != ed25519.SeedSize {
-		return false, fmt.Errorf("invalid seed size")
-	}
-
-	pubK := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
-
-	return c.IsMatchingPublicKey(pubK)
-}
-
 func NewServerClaims(identity string, collectives []string, org string, perms *ServerPermissions, additionalPublish []string, pk ed25519.PublicKey, issuer string, validity time.Duration) (*ServerClaims, error) {
 	if identity == "" {
 		return nil, fmt.Errorf("identity is required")
@@ -207,9 +163,9 @@ func ParseServerTokenUnverified(token string) (*ServerClaims, error) {
 }
 
 // ParseServerToken parses token and verifies it with pk
-func ParseServerToken(token string, pk any) (*ServerClaims, error) {
+func ParseServerToken(token string, pk any, opts ...ParseOption) (*ServerClaims, error) {
 	claims := &ServerClaims{}
-	err := ParseToken(token, claims, pk)
+	err := ParseToken(token, claims, pk, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("could not parse server id token: %w", err)
 	}
@@ -218,18 +174,28 @@ func ParseServerToken(token string, pk any) (*ServerClaims, error) {
 		return nil, ErrNotAServerToken
 	}
 
-	if claims.TrustChainSignature != "" {
+	err = claims.verified()
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// verified performs the checks needed once the signature of the token was verified
+func (s *ServerClaims) verified() error {
+	if s.TrustChainSignature != "" {
 		// if we have a tcs we require an issuer expiry to be set and it to not have expired
-		if !claims.verifyIssuerExpiry(true) {
-			return nil, jwt.ErrTokenExpired
+		if !s.verifyIssuerExpiry(true) {
+			return errIssuerExpired
 		}
 	}
 
-	return claims, nil
+	return nil
 }
 
-// ParseServerTokenWithKeyfile parses token and verifies it with the RSA Public key or ed25519 public key in pkFile
-func ParseServerTokenWithKeyfile(token string, pkFile string) (*ServerClaims, error) {
+// ParseServerTokenWithKeyfile parses token and verifies it with the RSA, ECDSA or ed25519 public key in pkFile
+func ParseServerTokenWithKeyfile(token string, pkFile string, opts ...ParseOption) (*ServerClaims, error) {
 	if pkFile == "" {
 		return nil, fmt.Errorf("invalid public key file")
 	}
@@ -239,10 +205,10 @@ func ParseServerTokenWithKeyfile(token string, pkFile string) (*ServerClaims, er
 		return nil, fmt.Errorf("could not read validation certificate: %s", err)
 	}
 
-	pk, err := readRSAOrED25519PublicData(certdat)
+	pk, err := readPublicKeyData(certdat)
 	if err != nil {
 		return nil, err
 	}
 
-	return ParseServerToken(token, pk)
+	return ParseServerToken(token, pk, opts...)
 }
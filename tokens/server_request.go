@@ -0,0 +1,231 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// DefaultServerTokenRequestValidity is the validity of server token requests when none is given
+const DefaultServerTokenRequestValidity = 10 * time.Minute
+
+// ServerTokenRequestClaims is a request by a node for a server token, it is signed using the seed matching PublicKey
+type ServerTokenRequestClaims struct {
+	// ChoriaIdentity is the identity the node requests
+	ChoriaIdentity string `json:"identity"`
+
+	// Collectives are the collectives the node requests to belong to
+	Collectives []string `json:"collectives"`
+
+	// OrganizationUnit is the organization unit the node requests to belong to
+	OrganizationUnit string `json:"ou,omitempty"`
+
+	StandardClaims
+}
+
+// ErrNotAServerTokenRequest indicates a token is not a server token request
+var ErrNotAServerTokenRequest error = newVerificationError(ErrWrongPurpose, nil, "not a server token request")
+
+// NewServerTokenRequestClaims creates a request for a server token, the request should be signed using the ed25519 seed matching pk
+func NewServerTokenRequestClaims(identity string, collectives []string, org string, pk ed25519.PublicKey, validity time.Duration) (*ServerTokenRequestClaims, error) {
+	if identity == "" {
+		return nil, fmt.Errorf("identity is required")
+	}
+
+	if len(collectives) == 0 {
+		return nil, fmt.Errorf("at least one collective is required")
+	}
+
+	if len(pk) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key is required")
+	}
+
+	if org == "" {
+		org = defaultOrg
+	}
+
+	if validity == 0 {
+		validity = DefaultServerTokenRequestValidity
+	}
+
+	stdClaims, err := newStandardClaims(identity, ServerTokenRequestPurpose, validity, false)
+	if err != nil {
+		return nil, err
+	}
+	stdClaims.PublicKey = hex.EncodeToString(pk)
+
+	return &ServerTokenRequestClaims{
+		ChoriaIdentity:   identity,
+		Collectives:      collectives,
+		OrganizationUnit: org,
+		StandardClaims:   *stdClaims,
+	}, nil
+}
+
+// IsServerTokenRequest determines if this is a server token request
+func IsServerTokenRequest(claims StandardClaims) bool {
+	return claims.Purpose == ServerTokenRequestPurpose
+}
+
+// ParseServerTokenRequest parses a server token request and verifies it is signed by the key it requests a token for
+func ParseServerTokenRequest(request string) (*ServerTokenRequestClaims, error) {
+	unverified := &ServerTokenRequestClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(request, unverified)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse server token request: %w", err)
+	}
+
+	pk, err := hex.DecodeString(unverified.PublicKey)
+	if err != nil || len(pk) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("could not parse server token request: invalid public key")
+	}
+
+	claims := &ServerTokenRequestClaims{}
+	err = ParseToken(request, claims, ed25519.PublicKey(pk))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse server token request: %w", err)
+	}
+
+	if !IsServerTokenRequest(claims.StandardClaims) {
+		return nil, ErrNotAServerTokenRequest
+	}
+
+	if claims.ChoriaIdentity == "" {
+		return nil, fmt.Errorf("identity is required")
+	}
+
+	if len(claims.Collectives) == 0 {
+		return nil, fmt.Errorf("at least one collective is required")
+	}
+
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("server token requests must expire")
+	}
+
+	if claims.OrganizationUnit == "" {
+		claims.OrganizationUnit = defaultOrg
+	}
+
+	return claims, nil
+}
+
+// ServerTokenPolicy determines which server token requests are allowed and what tokens are issued for them,
+// requests for anything not listed in the policy are denied
+type ServerTokenPolicy struct {
+	// Identities are patterns requested identities must match, like *.example.net
+	Identities []string
+
+	// Collectives are the collectives nodes may request, * allows all
+	Collectives []string
+
+	// OrganizationUnits are the organization units nodes may request, * allows all
+	OrganizationUnits []string
+
+	// Permissions are the permissions issued tokens hold
+	Permissions *ServerPermissions
+
+	// AdditionalPublishSubjects are additional subjects issued tokens may publish to
+	AdditionalPublishSubjects []string
+
+	// Validity is how long issued tokens are valid for, defaults to DefaultValidity
+	Validity time.Duration
+
+	// Issuer is the issuer set on tokens not issued by a chain issuer
+	Issuer string
+
+	// ChainIssuer issues tokens as part of a trust chain, the signer must be that of the chain issuer
+	ChainIssuer *ClientIDClaims
+
+	// Provisioned reports whether a node already holds a server token, nodes that are already provisioned can
+	// only exchange provisioning tokens that allow updates. Without it only provisioning tokens that allow updates
+	// can be exchanged
+	Provisioned func(identity string) (bool, error)
+}
+
+// Validate checks that request is allowed by the policy
+func (p *ServerTokenPolicy) Validate(request *ServerTokenRequestClaims) error {
+	if !matchesAnyPattern(p.Identities, request.ChoriaIdentity) {
+		return newVerificationError(ErrRequestDenied, nil, "identity %s is not allowed", request.ChoriaIdentity)
+	}
+
+	for _, collective := range request.Collectives {
+		if !stringInList(p.Collectives, "*") && !stringInList(p.Collectives, collective) {
+			return newVerificationError(ErrRequestDenied, nil, "collective %s is not allowed", collective)
+		}
+	}
+
+	ou := request.OrganizationUnit
+	if ou == "" {
+		ou = defaultOrg
+	}
+
+	if !stringInList(p.OrganizationUnits, "*") && !stringInList(p.OrganizationUnits, ou) {
+		return newVerificationError(ErrRequestDenied, nil, "organization unit %s is not allowed", ou)
+	}
+
+	return nil
+}
+
+// IssueServerToken verifies the server token request, checks it against policy and issues a server token signed by signer
+func IssueServerToken(request string, policy *ServerTokenPolicy, signer Signer) (string, *ServerClaims, error) {
+	if policy == nil {
+		return "", nil, fmt.Errorf("policy is required")
+	}
+
+	req, err := ParseServerTokenRequest(request)
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = policy.Validate(req)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return policy.issue(req, req.OrganizationUnit, signer)
+}
+
+// issue creates and signs a server token for the verified request in the organization unit ou
+func (p *ServerTokenPolicy) issue(req *ServerTokenRequestClaims, ou string, signer Signer) (string, *ServerClaims, error) {
+	pk, err := hex.DecodeString(req.PublicKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	validity := p.Validity
+	if validity == 0 {
+		validity = DefaultValidity
+	}
+
+	claims, err := NewServerClaims(req.ChoriaIdentity, req.Collectives, ou, p.Permissions, p.AdditionalPublishSubjects, pk, p.Issuer, validity)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if p.ChainIssuer != nil {
+		err = claims.AddChainIssuerData(p.ChainIssuer, signer)
+		if err != nil {
+			return "", nil, err
+		}
+
+		// issued tokens must not exceed the grants of the chain
+		err = validateChainGrants(claims)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	token, err := SignToken(claims, signer)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, claims, nil
+}
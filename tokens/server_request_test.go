@@ -0,0 +1,164 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	iu "github.com/choria-io/go-choria/internal/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ServerTokenRequestClaims", func() {
+	var (
+		nodePubK ed25519.PublicKey
+		nodePriK ed25519.PrivateKey
+		policy   *ServerTokenPolicy
+		signer   Signer
+		err      error
+	)
+
+	newRequest := func(identity string, collectives []string, org string) string {
+		req, err := NewServerTokenRequestClaims(identity, collectives, org, nodePubK, 0)
+		Expect(err).ToNot(HaveOccurred())
+		t, err := SignToken(req, mustSigner(nodePriK))
+		Expect(err).ToNot(HaveOccurred())
+		return t
+	}
+
+	BeforeEach(func() {
+		nodePubK, nodePriK, err = iu.Ed25519KeyPair()
+		Expect(err).ToNot(HaveOccurred())
+
+		signer = mustSigner(loadRSAPriKey("testdata/rsa/signer-key.pem"))
+		policy = &ServerTokenPolicy{
+			Identities:        []string{"*.example.net"},
+			Collectives:       []string{"choria", "dev"},
+			OrganizationUnits: []string{"choria"},
+			Permissions:       &ServerPermissions{Submission: true},
+			Validity:          24 * time.Hour,
+		}
+	})
+
+	Describe("NewServerTokenRequestClaims", func() {
+		It("Should validate the request", func() {
+			_, err := NewServerTokenRequestClaims("", []string{"choria"}, "", nodePubK, 0)
+			Expect(err).To(MatchError("identity is required"))
+			_, err = NewServerTokenRequestClaims("n1.example.net", nil, "", nodePubK, 0)
+			Expect(err).To(MatchError("at least one collective is required"))
+			_, err = NewServerTokenRequestClaims("n1.example.net", []string{"choria"}, "", nil, 0)
+			Expect(err).To(MatchError("public key is required"))
+		})
+
+		It("Should create the request", func() {
+			req, err := NewServerTokenRequestClaims("n1.example.net", []string{"choria"}, "", nodePubK, 0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(req.Purpose).To(Equal(ServerTokenRequestPurpose))
+			Expect(req.Issuer).To(Equal("n1.example.net"))
+			Expect(req.OrganizationUnit).To(Equal("choria"))
+			Expect(req.PublicKey).To(Equal(hex.EncodeToString(nodePubK)))
+			Expect(req.ExpiresAt.Time).To(BeTemporally("~", time.Now().Add(DefaultServerTokenRequestValidity), time.Second))
+		})
+	})
+
+	Describe("ParseServerTokenRequest", func() {
+		It("Should verify the self signature", func() {
+			req, err := ParseServerTokenRequest(newRequest("n1.example.net", []string{"choria"}, ""))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(req.ChoriaIdentity).To(Equal("n1.example.net"))
+
+			// signed by a key other than the one requested
+			_, otherPriK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			claims, err := NewServerTokenRequestClaims("n1.example.net", []string{"choria"}, "", nodePubK, 0)
+			Expect(err).ToNot(HaveOccurred())
+			t, err := SignToken(claims, mustSigner(otherPriK))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = ParseServerTokenRequest(t)
+			Expect(err).To(MatchError("could not parse server token request: ed25519: verification error"))
+
+			// signed using rsa
+			t, err = SignToken(claims, signer)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = ParseServerTokenRequest(t)
+			Expect(errors.Is(err, ErrBadKeyType)).To(BeTrue())
+		})
+
+		It("Should check the purpose", func() {
+			server, err := NewServerClaims("n1.example.net", []string{"choria"}, "", nil, nil, nodePubK, "", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			t, err := SignToken(server, mustSigner(nodePriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseServerTokenRequest(t)
+			Expect(err).To(MatchError("not a server token request"))
+			Expect(errors.Is(err, ErrWrongPurpose)).To(BeTrue())
+		})
+	})
+
+	Describe("IssueServerToken", func() {
+		It("Should issue tokens for allowed requests", func() {
+			t, claims, err := IssueServerToken(newRequest("n1.example.net", []string{"choria", "dev"}, ""), policy, signer)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(claims.ChoriaIdentity).To(Equal("n1.example.net"))
+
+			server, err := ParseServerToken(t, loadRSAPubKey("testdata/rsa/signer-public.pem"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.ChoriaIdentity).To(Equal("n1.example.net"))
+			Expect(server.Collectives).To(Equal([]string{"choria", "dev"}))
+			Expect(server.Permissions.Submission).To(BeTrue())
+			Expect(server.ExpiresAt.Time).To(BeTemporally("~", time.Now().Add(24*time.Hour), time.Second))
+			Expect(server.IsMatchingPublicKey(nodePubK)).To(BeTrue())
+		})
+
+		It("Should enforce the policy", func() {
+			_, _, err := IssueServerToken(newRequest("n1.example.com", []string{"choria"}, ""), policy, signer)
+			Expect(err).To(MatchError("identity n1.example.com is not allowed"))
+			Expect(errors.Is(err, ErrRequestDenied)).To(BeTrue())
+
+			_, _, err = IssueServerToken(newRequest("n1.example.net", []string{"prod"}, ""), policy, signer)
+			Expect(err).To(MatchError("collective prod is not allowed"))
+
+			_, _, err = IssueServerToken(newRequest("n1.example.net", []string{"choria"}, "acme"), policy, signer)
+			Expect(err).To(MatchError("organization unit acme is not allowed"))
+
+			policy.Collectives = []string{"*"}
+			policy.OrganizationUnits = []string{"*"}
+			_, claims, err := IssueServerToken(newRequest("n1.example.net", []string{"prod"}, "acme"), policy, signer)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(claims.OrganizationUnit).To(Equal("acme"))
+
+			_, _, err = IssueServerToken(newRequest("n1.example.net", []string{"prod"}, "acme"), nil, signer)
+			Expect(err).To(MatchError("policy is required"))
+		})
+
+		It("Should issue tokens using chain issuers", func() {
+			orgPubK, orgPriK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			handlerPubK, handlerPriK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+
+			handler, err := NewClientIDClaims("choria=registration", nil, "", nil, "", "", time.Hour, nil, handlerPubK)
+			Expect(err).ToNot(HaveOccurred())
+			handler.ChainGrant = &ChainGrant{Identities: []string{"n1.example.net"}, OrganizationUnits: []string{"choria"}, ServerPermissions: &ServerPermissions{Submission: true}}
+			Expect(handler.AddOrgIssuerData(mustSigner(orgPriK))).To(Succeed())
+			policy.ChainIssuer = handler
+
+			t, _, err := IssueServerToken(newRequest("n1.example.net", []string{"choria"}, ""), policy, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+
+			server, err := ParseServerToken(t, orgPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.ExpiresAt.Unix()).To(Equal(handler.ExpiresAt.Unix()))
+
+			_, _, err = IssueServerToken(newRequest("n2.example.net", []string{"choria"}, ""), policy, mustSigner(handlerPriK))
+			Expect(err).To(MatchError("identity n2.example.net is not granted by chain issuer " + handler.ID))
+		})
+	})
+})
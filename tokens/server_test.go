@@ -242,6 +242,20 @@ var _ = Describe("ServerClaims", func() {
 			Expect(claims.ChoriaIdentity).To(Equal("ginkgo.example.net"))
 		})
 
+		It("Should parse valid ecdsa tokens", func() {
+			claims, err := NewServerClaims("ginkgo.example.net", []string{"choria"}, "ginkgo_org", nil, nil, pubK, "ginkgo issuer", 365*24*time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			signed, err := SignTokenWithKeyFile(claims, "testdata/ecdsa/signer-key.pem")
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = ParseServerTokenWithKeyfile(signed, "testdata/ecdsa/other-public.pem")
+			Expect(err).To(MatchError("could not parse server id token: crypto/ecdsa: verification error"))
+
+			claims, err = ParseServerTokenWithKeyfile(signed, "testdata/ecdsa/signer-cert.pem")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(claims.ChoriaIdentity).To(Equal("ginkgo.example.net"))
+		})
+
 		It("Should parse valid ed25519 tokens", func() {
 			perms := &ServerPermissions{Submission: true}
 			claims, err := NewServerClaims("ginkgo.example.net", []string{"choria"}, "ginkgo_org", perms, nil, pubK, "ginkgo issuer", 365*24*time.Hour)
@@ -0,0 +1,249 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Signer signs tokens using a private key that might not be held in memory
+type Signer interface {
+	// Algorithm is the JWT signing algorithm the signer produces, like EdDSA or RS256
+	Algorithm() string
+
+	// KeyID is an optional identifier for the key used to sign, when set it is added to the token kid header
+	KeyID() string
+
+	// Public is the public key matching the signing key, nil when it can not be determined
+	Public() crypto.PublicKey
+
+	// Sign signs data and returns the raw signature
+	Sign(data []byte) ([]byte, error)
+}
+
+// SignerOption configures a Signer
+type SignerOption func(*signerOpts) error
+
+type signerOpts struct {
+	kid       string
+	alg       string
+	deriveKid bool
+}
+
+// WithSignerKeyID sets the key id a signer will report, defaults to the PublicKeyID of the signing key
+func WithSignerKeyID(kid string) SignerOption {
+	return func(o *signerOpts) error {
+		o.kid = kid
+		return nil
+	}
+}
+
+// WithDerivedKeyID derives the key id from the public key of signers that only derive it on request, like Vault signers
+// where this requires retrieving the public key from Vault
+func WithDerivedKeyID() SignerOption {
+	return func(o *signerOpts) error {
+		o.deriveKid = true
+		return nil
+	}
+}
+
+// WithSigningAlgorithm selects the algorithm used by RSA keys, one of RS256, RS384, RS512, PS256, PS384 or PS512, defaults to RS256.
+//
+// Other key types only support their natural algorithm.
+func WithSigningAlgorithm(alg string) SignerOption {
+	return func(o *signerOpts) error {
+		if jwt.GetSigningMethod(alg) == nil {
+			return fmt.Errorf("unknown signing algorithm %q", alg)
+		}
+
+		o.alg = alg
+		return nil
+	}
+}
+
+type keySigner struct {
+	method jwt.SigningMethod
+	key    crypto.PrivateKey
+	pub    crypto.PublicKey
+	kid    string
+}
+
+// NewKeySigner creates a Signer for an in-memory ed25519, RSA or ECDSA private key, ECDSA keys must use the P-256 or P-384 curves
+func NewKeySigner(pk crypto.PrivateKey, opts ...SignerOption) (Signer, error) {
+	sopts := &signerOpts{}
+	for _, opt := range opts {
+		err := opt(sopts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s := &keySigner{key: pk, kid: sopts.kid}
+
+	switch pri := pk.(type) {
+	case ed25519.PrivateKey:
+		if len(pri) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("invalid ed25519 private key size")
+		}
+		s.method = jwt.SigningMethodEdDSA
+		s.pub = pri.Public()
+
+	case *rsa.PrivateKey:
+		s.method = jwt.SigningMethodRS256
+		s.pub = pri.Public()
+
+		switch sopts.alg {
+		case "":
+		case algRS256, algRS384, algRS512, algPS256, algPS384, algPS512:
+			s.method = jwt.GetSigningMethod(sopts.alg)
+		default:
+			return nil, fmt.Errorf("unsupported signing algorithm %s for rsa keys", sopts.alg)
+		}
+
+	case *ecdsa.PrivateKey:
+		method, err := ecdsaSigningMethod(pri.Curve)
+		if err != nil {
+			return nil, err
+		}
+		s.method = method
+		s.pub = pri.Public()
+
+	default:
+		return nil, fmt.Errorf("unsupported private key")
+	}
+
+	if sopts.alg != "" && sopts.alg != s.method.Alg() {
+		return nil, fmt.Errorf("unsupported signing algorithm %s for %s keys", sopts.alg, s.method.Alg())
+	}
+
+	if s.kid == "" {
+		kid, err := PublicKeyID(s.pub)
+		if err != nil {
+			return nil, err
+		}
+		s.kid = kid
+	}
+
+	return s, nil
+}
+
+// NewFileSigner creates a Signer using a RSA or ECDSA Private Key in PEM format, a ed25519 key in PKCS8 or OpenSSH format or a hex encoded ed25519 seed stored in pkFile
+func NewFileSigner(pkFile string, opts ...SignerOption) (Signer, error) {
+	keydat, err := os.ReadFile(pkFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read signing key: %s", err)
+	}
+
+	pk, err := readPrivateKeyData(keydat)
+	if err != nil {
+		return nil, err
+	}
+	if pk == nil {
+		return nil, fmt.Errorf("unsupported key in %v", pkFile)
+	}
+
+	return NewKeySigner(pk, opts...)
+}
+
+func (s *keySigner) Algorithm() string        { return s.method.Alg() }
+func (s *keySigner) KeyID() string            { return s.kid }
+func (s *keySigner) Public() crypto.PublicKey { return s.pub }
+
+func (s *keySigner) Sign(data []byte) ([]byte, error) {
+	sig, err := s.method.Sign(string(data), s.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return jwt.DecodeSegment(sig)
+}
+
+// reads a RSA or ECDSA PEM key, a PKCS8 or OpenSSH ed25519 key or a ed25519 seed, returns nil without error for unknown formats
+func readPrivateKeyData(keydat []byte) (crypto.PrivateKey, error) {
+	switch {
+	case bytes.HasPrefix(keydat, []byte(rsaKeyHeader)):
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(keydat)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse signing key: %s", err)
+		}
+
+		return key, nil
+
+	case bytes.HasPrefix(keydat, []byte(ecKeyHeader)):
+		key, err := jwt.ParseECPrivateKeyFromPEM(keydat)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse signing key: %s", err)
+		}
+
+		return key, nil
+
+	case bytes.HasPrefix(keydat, []byte(keyHeader)):
+		block, _ := pem.Decode(keydat)
+		if block == nil {
+			return nil, fmt.Errorf("could not parse signing key: invalid pem data")
+		}
+
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse signing key: %s", err)
+		}
+
+		return key, nil
+
+	case bytes.HasPrefix(keydat, []byte(opensshKeyHeader)):
+		return parseOpenSSHEd25519PrivateKey(keydat)
+	}
+
+	if len(keydat) == ed25519.PrivateKeySize {
+		seed, err := hex.DecodeString(string(keydat))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ed25519 seed file: %v", err)
+		}
+
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+
+	return nil, nil
+}
+
+func ecdsaSigningMethod(curve elliptic.Curve) (jwt.SigningMethod, error) {
+	switch curve {
+	case elliptic.P256():
+		return jwt.SigningMethodES256, nil
+	case elliptic.P384():
+		return jwt.SigningMethodES384, nil
+	default:
+		return nil, fmt.Errorf("unsupported ecdsa curve %s", curve.Params().Name)
+	}
+}
+
+func signerEd25519PublicKey(signer Signer) (ed25519.PublicKey, error) {
+	if signer == nil {
+		return nil, fmt.Errorf("signer is required")
+	}
+
+	if signer.Algorithm() != algEdDSA {
+		return nil, fmt.Errorf("ed25519 signer required")
+	}
+
+	pubK, ok := signer.Public().(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("could not determine signer ed25519 public key")
+	}
+
+	return pubK, nil
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	iu "github.com/choria-io/go-choria/internal/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Signer", func() {
+	Describe("NewKeySigner", func() {
+		It("Should support ed25519 keys", func() {
+			pubK, priK := loadEd25519Seed("testdata/ed25519/signer.seed")
+			signer, err := NewKeySigner(priK, WithSignerKeyID("ginkgo"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signer.Algorithm()).To(Equal("EdDSA"))
+			Expect(signer.KeyID()).To(Equal("ginkgo"))
+			Expect(signer.Public()).To(Equal(pubK))
+
+			sig, err := signer.Sign([]byte("hello"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ed25519.Verify(pubK, []byte("hello"), sig)).To(BeTrue())
+		})
+
+		It("Should support rsa keys", func() {
+			signer, err := NewKeySigner(loadRSAPriKey("testdata/rsa/signer-key.pem"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signer.Algorithm()).To(Equal("RS256"))
+			Expect(signer.Public()).To(Equal(loadRSAPubKey("testdata/rsa/signer-public.pem")))
+
+			kid, err := PublicKeyID(signer.Public())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signer.KeyID()).To(Equal(kid))
+		})
+
+		It("Should support ecdsa keys", func() {
+			pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			signer, err := NewKeySigner(pk)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signer.Algorithm()).To(Equal("ES256"))
+
+			pk, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			signer, err = NewKeySigner(pk)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signer.Algorithm()).To(Equal("ES384"))
+
+			pk, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = NewKeySigner(pk)
+			Expect(err).To(MatchError("unsupported ecdsa curve P-521"))
+		})
+
+		It("Should reject unsupported keys", func() {
+			_, err := NewKeySigner("x")
+			Expect(err).To(MatchError("unsupported private key"))
+
+			_, err = NewKeySigner(ed25519.PrivateKey("x"))
+			Expect(err).To(MatchError("invalid ed25519 private key size"))
+		})
+	})
+
+	Describe("NewFileSigner", func() {
+		It("Should load supported files", func() {
+			signer, err := NewFileSigner("testdata/ed25519/signer.seed")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signer.Algorithm()).To(Equal("EdDSA"))
+
+			signer, err = NewFileSigner("testdata/rsa/signer-key.pem")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signer.Algorithm()).To(Equal("RS256"))
+
+			signer, err = NewFileSigner("testdata/ecdsa/signer-key.pem")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signer.Algorithm()).To(Equal("ES256"))
+
+			signer, err = NewFileSigner("testdata/ecdsa/p384-key.pem")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signer.Algorithm()).To(Equal("ES384"))
+
+			signer, err = NewFileSigner("testdata/ed25519/signer-key.pem")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signer.Public()).To(Equal(readEd25519PublicKeyFile("testdata/ed25519/signer.public")))
+
+			signer, err = NewFileSigner("testdata/ed25519/openssh.key")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signer.Algorithm()).To(Equal("EdDSA"))
+			Expect(signer.Public()).To(Equal(readEd25519PublicKeyFile("testdata/ed25519/openssh.public")))
+		})
+
+		It("Should not support encrypted OpenSSH keys", func() {
+			_, err := NewFileSigner("testdata/ed25519/openssh-encrypted.key")
+			Expect(err).To(MatchError("could not parse signing key: encrypted openssh keys are not supported"))
+		})
+
+		It("Should fail for unsupported files", func() {
+			_, err := NewFileSigner("testdata/rsa/signer-public.pem")
+			Expect(err).To(MatchError("unsupported key in testdata/rsa/signer-public.pem"))
+		})
+	})
+
+	Describe("Chain issuing", func() {
+		It("Should create valid chains using signers", func() {
+			issuerPubK, issuerPriK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			handlerPubK, handlerPriK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			userPubK, _, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+
+			handler, err := NewClientIDClaims("choria=handler", nil, "", nil, "", "", time.Hour, nil, handlerPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(handler.AddOrgIssuerData(mustSigner(loadRSAPriKey("testdata/rsa/signer-key.pem")))).To(MatchError("ed25519 signer required"))
+			Expect(handler.AddOrgIssuerData(mustSigner(issuerPriK))).To(Succeed())
+			Expect(handler.Issuer).To(Equal("I-" + hex.EncodeToString(issuerPubK)))
+			Expect(handler.IsChainedIssuer(true)).To(BeTrue())
+
+			user, err := NewClientIDClaims("choria=user", nil, "", nil, "", "", time.Hour, nil, userPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(user.AddChainIssuerData(handler, mustSigner(issuerPriK))).To(MatchError("signer does not match the chain issuer public key"))
+			Expect(user.AddChainIssuerData(handler, mustSigner(handlerPriK))).To(Succeed())
+
+			ok, signerPubK, err := user.IsSignedByIssuer(issuerPubK)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(signerPubK).To(Equal(handlerPubK))
+
+			token, err := SignToken(user, mustSigner(handlerPriK))
+			Expect(err).ToNot(HaveOccurred())
+			parsed, err := ParseClientIDToken(token, issuerPubK, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed.CallerID).To(Equal("choria=user"))
+		})
+	})
+})
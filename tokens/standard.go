@@ -5,9 +5,11 @@
 package tokens
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"encoding/hex"
 	"fmt"
+	"os"
 	"strings"
 	"time"
 
@@ -29,9 +31,31 @@ type StandardClaims struct {
 	// IssuerExpiresAt is the expiry time of the issuer, if set will be checked in addition to the expiry time of the token itself
 	IssuerExpiresAt *jwt.NumericDate `json:"issexp,omitempty"`
 
+	// IssuerChain are the chain issuers between the org issuer and the issuer of this token, starting with the one issued by the org issuer
+	IssuerChain []ChainIssuer `json:"ichain,omitempty"`
+
+	// ChainDelegate indicates this token may issue tokens on behalf of its chain issuer
+	ChainDelegate bool `json:"delegate,omitempty"`
+
+	// ChainGrant limits what a chain issuer may delegate to tokens it issues, must be set before the chain issuer is signed
+	ChainGrant *ChainGrant `json:"chain_grant,omitempty"`
+
+	// IssuerGrant is the ChainGrant of the issuer of this token
+	IssuerGrant *ChainGrant `json:"issgrant,omitempty"`
+
 	jwt.RegisteredClaims
 }
 
+// Claims is implemented by all claims that embed StandardClaims, claims defined outside this package implement it by embedding StandardClaims
+type Claims interface {
+	jwt.Claims
+	standardClaims() *StandardClaims
+}
+
+func (s *StandardClaims) standardClaims() *StandardClaims {
+	return s
+}
+
 // ExpireTime determines the expiry time based on issuer expiry and token expiry
 func (s *StandardClaims) ExpireTime() time.Time {
 	var iexp, exp time.Time
@@ -63,26 +87,40 @@ func (s *StandardClaims) IsExpired() bool {
 }
 
 // AddOrgIssuerData adds the data that a Chain Issuer needs to be able to issue clients in an Org managed by an Issuer
-func (c *StandardClaims) AddOrgIssuerData(priK ed25519.PrivateKey) error {
+func (c *StandardClaims) AddOrgIssuerData(signer Signer) error {
+	pubK, err := signerEd25519PublicKey(signer)
+	if err != nil {
+		return err
+	}
+
 	dat, err := c.OrgIssuerChainData()
 	if err != nil {
 		return err
 	}
 
-	sig, err := iu.Ed25519Sign(priK, dat)
+	sig, err := signer.Sign(dat)
 	if err != nil {
 		return err
 	}
 
-	c.SetOrgIssuer(priK.Public().(ed25519.PublicKey))
+	c.SetOrgIssuer(pubK)
 	c.SetChainIssuerTrustSignature(sig)
 
 	return nil
 }
 
 // AddChainIssuerData adds the data that a Signed token needs from a Chain Issuer in an Org managed by an Issuer
-func (c *StandardClaims) AddChainIssuerData(chainIssuer *ClientIDClaims, prik ed25519.PrivateKey) error {
-	err := c.SetChainIssuer(chainIssuer)
+func (c *StandardClaims) AddChainIssuerData(chainIssuer *ClientIDClaims, signer Signer) error {
+	pubK, err := signerEd25519PublicKey(signer)
+	if err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(pubK) != chainIssuer.PublicKey {
+		return fmt.Errorf("signer does not match the chain issuer public key")
+	}
+
+	err = c.SetChainIssuer(chainIssuer)
 	if err != nil {
 		return err
 	}
@@ -92,7 +130,7 @@ func (c *StandardClaims) AddChainIssuerData(chainIssuer *ClientIDClaims, prik ed
 		return err
 	}
 
-	usig, err := iu.Ed25519Sign(prik, udat)
+	usig, err := signer.Sign(udat)
 	if err != nil {
 		return err
 	}
@@ -121,13 +159,23 @@ func (c *StandardClaims) verifyIssuerExpiry(req bool) bool {
 	return !c.IsExpired()
 }
 
-// IsChainedIssuer determines if this is a token capable of issuing users as part of a chain
+// IsChainedIssuer determines if this is a token capable of issuing users as part of a chain, either issued by the org issuer or a chain delegate
 // without verify being true one can not be 100% certain it's valid to do that but its a strong hint
 func (c *StandardClaims) IsChainedIssuer(verify bool) bool {
 	if len(c.TrustChainSignature) == 0 {
 		return false
 	}
 
+	// delegates are verified up to, but not including, the org issuer, use IsSignedByIssuer to verify the full chain
+	if c.ChainDelegate && strings.HasPrefix(c.Issuer, ChainIssuerPrefix) {
+		if !verify {
+			return true
+		}
+
+		_, err := c.verifyChain(nil, newParseOpts(nil))
+		return err == nil
+	}
+
 	if !strings.HasPrefix(c.Issuer, OrgIssuerPrefix) {
 		return false
 	}
@@ -166,7 +214,12 @@ func (c *StandardClaims) OrgIssuerChainData() ([]byte, error) {
 		return nil, fmt.Errorf("no public key set")
 	}
 
-	return []byte(fmt.Sprintf("%s.%s", c.ID, c.PublicKey)), nil
+	grant, err := chainGrantData(c.ChainGrant)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(fmt.Sprintf("%s.%s%s", c.ID, c.PublicKey, grant)), nil
 }
 
 // SetOrgIssuer sets the issuer field for users issued by the Org Issuer
@@ -175,7 +228,8 @@ func (c *StandardClaims) SetOrgIssuer(pk ed25519.PublicKey) {
 	c.Issuer = fmt.Sprintf("%s%s", OrgIssuerPrefix, hex.EncodeToString(pk))
 }
 
-// SetChainIssuer used by Login Handlers that create users in a chain to set an appropriate issuer on created users
+// SetChainIssuer used by Login Handlers that create users in a chain to set an appropriate issuer on created users,
+// ci can be issued by the org issuer or be a chain delegate
 // See AddChainIssuerData for a one-shot way to set the needed data when you have access to the private key.
 func (c *StandardClaims) SetChainIssuer(ci *ClientIDClaims) error {
 	if ci.ID == "" {
@@ -189,8 +243,24 @@ func (c *StandardClaims) SetChainIssuer(ci *ClientIDClaims) error {
 		return fmt.Errorf("issuer has no expiry")
 	}
 
+	// when the issuer is itself issued by a chain issuer it extends the chain
+	var chain []ChainIssuer
+	if strings.HasPrefix(ci.Issuer, ChainIssuerPrefix) {
+		if !ci.ChainDelegate {
+			return fmt.Errorf("issuer is not a chain delegate")
+		}
+
+		var err error
+		chain, err = ci.ChainIssuers()
+		if err != nil {
+			return err
+		}
+	}
+
 	c.Issuer = fmt.Sprintf("%s%s.%s", ChainIssuerPrefix, ci.ID, ci.PublicKey)
-	c.IssuerExpiresAt = ci.ExpiresAt
+	c.IssuerChain = chain
+	c.IssuerGrant = ci.ChainGrant
+	c.IssuerExpiresAt = jwt.NewNumericDate(ci.ExpireTime())
 
 	if c.ExpiresAt == nil || c.IssuerExpiresAt.Before(c.ExpiresAt.Time) {
 		c.ExpiresAt = ci.ExpiresAt
@@ -242,14 +312,14 @@ func (c *StandardClaims) ParseChainIssuerData() (id string, pk ed25519.PublicKey
 	issuerChainData := strings.TrimPrefix(c.Issuer, ChainIssuerPrefix)
 	parts := strings.Split(issuerChainData, ".")
 	if len(parts) != 2 {
-		return "", nil, "", nil, fmt.Errorf("invalid issuer content")
+		return "", nil, "", nil, errMalformedChainData("invalid issuer content")
 	}
 
 	if len(parts[0]) == 0 {
-		return "", nil, "", nil, fmt.Errorf("invalid id in issuer")
+		return "", nil, "", nil, errMalformedChainData("invalid id in issuer")
 	}
 	if len(parts[1]) == 0 {
-		return "", nil, "", nil, fmt.Errorf("invalid public key in issuer")
+		return "", nil, "", nil, errMalformedChainData("invalid public key in issuer")
 	}
 
 	id = parts[0]
@@ -257,57 +327,143 @@ func (c *StandardClaims) ParseChainIssuerData() (id string, pk ed25519.PublicKey
 
 	hPubk, err := hex.DecodeString(pks)
 	if err != nil {
-		return "", nil, "", nil, fmt.Errorf("invalid public key in issuer data")
+		return "", nil, "", nil, errMalformedChainData("invalid public key in issuer data")
 	}
 
 	parts = strings.Split(c.TrustChainSignature, ".")
-	if len(parts) != 2 {
-		return "", nil, "", nil, fmt.Errorf("invalid trust chain signature")
+	if len(parts) < 2 {
+		return "", nil, "", nil, errMalformedChainData("invalid trust chain signature")
 	}
-	if len(parts[0]) == 0 || len(parts[1]) == 0 {
-		return "", nil, "", nil, fmt.Errorf("invalid trust chain signature")
+	for _, part := range parts {
+		if len(part) == 0 {
+			return "", nil, "", nil, errMalformedChainData("invalid trust chain signature")
+		}
 	}
-	tcs = parts[0]
-	sig, err = hex.DecodeString(parts[1])
+	tcs = strings.Join(parts[:len(parts)-1], ".")
+	sig, err = hex.DecodeString(parts[len(parts)-1])
 	if err != nil {
-		return "", nil, "", nil, fmt.Errorf("invalid signature in chain signature: %w", err)
+		return "", nil, "", nil, newVerificationError(ErrMalformedChainData, err, "invalid signature in chain signature: %s", err)
 	}
 
 	return id, hPubk, tcs, sig, err
 }
 
+// IsMatchingPublicKey checks that the stored public key matches the supplied one
+func (c *StandardClaims) IsMatchingPublicKey(pubK ed25519.PublicKey) (bool, error) {
+	if c.PublicKey == "" {
+		return false, fmt.Errorf("no public key stored in the JWT")
+	}
+
+	if len(pubK) != ed25519.PublicKeySize {
+		return false, fmt.Errorf("invalid size for public key")
+	}
+
+	jpubK, err := hex.DecodeString(c.PublicKey)
+	if err != nil {
+		return false, err
+	}
+
+	if len(jpubK) != ed25519.PublicKeySize {
+		return false, fmt.Errorf("invalid size for token stored public key")
+	}
+
+	return bytes.Equal(jpubK, pubK), nil
+}
+
+// IsMatchingSeedFile determines if the token public key matches the hex encoded ed25519 seed in file
+func (c *StandardClaims) IsMatchingSeedFile(file string) (bool, error) {
+	sb, err := os.ReadFile(file)
+	if err != nil {
+		return false, err
+	}
+
+	seed, err := hex.DecodeString(string(sb))
+	if err != nil {
+		return false, err
+	}
+
+	if len(seed) != ed25519.SeedSize {
+		return false, fmt.Errorf("invalid seed size")
+	}
+
+	pubK := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+
+	return c.IsMatchingPublicKey(pubK)
+}
+
+// IsMatchingPrivateKeyFile determines if the token public key matches the ed25519 private key in file, the key can be
+// a hex encoded seed, a PKCS8 PEM key or an unencrypted OpenSSH key
+func (c *StandardClaims) IsMatchingPrivateKeyFile(file string) (bool, error) {
+	keydat, err := os.ReadFile(file)
+	if err != nil {
+		return false, err
+	}
+
+	pk, err := readPrivateKeyData(bytes.TrimSpace(keydat))
+	if err != nil {
+		return false, err
+	}
+
+	priK, ok := pk.(ed25519.PrivateKey)
+	if !ok {
+		return false, fmt.Errorf("%s does not hold an ed25519 private key", file)
+	}
+
+	return c.IsMatchingPublicKey(priK.Public().(ed25519.PublicKey))
+}
+
+// VerifyKeyPairFile ensures the token public key matches the ed25519 private key in file, see IsMatchingPrivateKeyFile
+func (c *StandardClaims) VerifyKeyPairFile(file string) error {
+	match, err := c.IsMatchingPrivateKeyFile(file)
+	if err != nil {
+		return fmt.Errorf("could not compare token public key to private key %s: %w", file, err)
+	}
+
+	if !match {
+		return fmt.Errorf("token public key %s does not match private key %s", c.PublicKey, file)
+	}
+
+	return nil
+}
+
 func (c *StandardClaims) verifyIssuerRequiredClaims() error {
 	if c.Issuer == "" {
-		return fmt.Errorf("no issuer set")
+		return errMalformedChainData("no issuer set")
 	}
-	if c.PublicKey == "" {
-		return fmt.Errorf("no public key set")
+	// provisioning tokens issued by a chain issuer are not bound to a key unless they are delegates
+	keyOptional := IsProvisioningToken(*c) && strings.HasPrefix(c.Issuer, ChainIssuerPrefix) && !c.ChainDelegate
+	if c.PublicKey == "" && !keyOptional {
+		return errMalformedChainData("no public key set")
 	}
 	if c.TrustChainSignature == "" {
-		return fmt.Errorf("no trust chain signature set")
+		return errMalformedChainData("no trust chain signature set")
 	}
 	if c.ID == "" {
-		return fmt.Errorf("id not set")
+		return errMalformedChainData("id not set")
 	}
 	if c.IssuedAt == nil || c.IssuedAt.IsZero() {
-		return fmt.Errorf("no issued time set")
+		return errMalformedChainData("no issued time set")
 	}
 	if c.ExpiresAt == nil || c.ExpiresAt.IsZero() {
-		return fmt.Errorf("no expires set")
+		return errMalformedChainData("no expires set")
 	}
 	kid, err := ksuid.Parse(c.ID)
 	if err != nil {
-		return fmt.Errorf("invalid ksuid format")
+		return errMalformedChainData("invalid ksuid format")
 	}
 	if !c.IssuedAt.Equal(kid.Time()) {
-		return fmt.Errorf("id is not based on issued time")
+		return errMalformedChainData("id is not based on issued time")
 	}
 
 	return nil
 }
 
 // IsSignedByIssuer uses the chain data in Issuer and TrustChainSignature to determine if an issuer signed a token
-func (c *StandardClaims) IsSignedByIssuer(pk ed25519.PublicKey) (bool, ed25519.PublicKey, error) {
+func (c *StandardClaims) IsSignedByIssuer(pk ed25519.PublicKey, opts ...ParseOption) (bool, ed25519.PublicKey, error) {
+	return c.isSignedByIssuer(pk, newParseOpts(opts))
+}
+
+func (c *StandardClaims) isSignedByIssuer(pk ed25519.PublicKey, opts *parseOpts) (bool, ed25519.PublicKey, error) {
 	err := c.verifyIssuerRequiredClaims()
 	if err != nil {
 		return false, nil, err
@@ -323,13 +479,15 @@ func (c *StandardClaims) IsSignedByIssuer(pk ed25519.PublicKey) (bool, ed25519.P
 		// So we simply check if the signature in the TrustChainSignature match the data if signed by the
 		// supplied issuer public key
 
-		if c.Issuer != fmt.Sprintf("%s%s", OrgIssuerPrefix, hex.EncodeToString(pk)) {
-			return false, nil, fmt.Errorf("public keys do not match")
+		// during org issuer rotation the issuer may be one endorsed by pk
+		orgPK, ok := opts.orgIssuerKey(pk, c.Issuer)
+		if !ok {
+			return false, nil, newVerificationError(ErrIssuerMismatch, nil, "public keys do not match")
 		}
 
 		sig, err := hex.DecodeString(c.TrustChainSignature)
 		if err != nil {
-			return false, nil, fmt.Errorf("invalid trust chain signature: %w", err)
+			return false, nil, newVerificationError(ErrMalformedChainData, err, "invalid trust chain signature: %s", err)
 		}
 
 		dat, err := c.OrgIssuerChainData()
@@ -337,12 +495,19 @@ func (c *StandardClaims) IsSignedByIssuer(pk ed25519.PublicKey) (bool, ed25519.P
 			return false, nil, err
 		}
 
-		valid, err := iu.Ed25519Verify(pk, dat, sig)
+		valid, err := iu.Ed25519Verify(orgPK, dat, sig)
 		if err != nil {
 			return false, nil, err
 		}
 
-		return valid, pk, err
+		if valid && opts.revocations != nil {
+			err = opts.revocations.checkChainIssuer(c.ID, c.PublicKey)
+			if err != nil {
+				return false, nil, err
+			}
+		}
+
+		return valid, orgPK, err
 
 	case strings.HasPrefix(c.Issuer, ChainIssuerPrefix):
 		// This is a token that was created by one in the chain - not the org issuer.
@@ -359,29 +524,23 @@ func (c *StandardClaims) IsSignedByIssuer(pk ed25519.PublicKey) (bool, ed25519.P
 		// the creator since its in the tcs set there by our trusted issuer.
 		//
 		// We can confirm the tcs is valid and matches whats in the sig made by
-		// the creator because we verify it using the requested issuer pubk
+		// the creator because we verify it using the requested issuer pubk.
+		//
+		// When the creator is a chain delegate the chain holds further links,
+		// each chain issuer is listed in IssuerChain and every link is verified
+		// back to the org issuer, see verifyChain()
 		if c.IssuerExpiresAt == nil || c.IssuerExpiresAt.IsZero() {
-			return false, nil, fmt.Errorf("no issuer expires set")
+			return false, nil, errMalformedChainData("no issuer expires set")
 		}
 
-		_, hPubk, tcs, sig, err := c.ParseChainIssuerData()
+		hPubk, err := c.verifyChain(pk, opts)
 		if err != nil {
 			return false, nil, err
 		}
 
-		// this is the signature from the handler
-		// now we check the signature is data + "." + sig(id+ "." + data)
-		ok, err := iu.Ed25519Verify(hPubk, []byte(fmt.Sprintf("%s.%s", c.ID, tcs)), sig)
-		if err != nil {
-			return false, nil, fmt.Errorf("chain signature validation failed: %w", err)
-		}
-		if !ok {
-			return false, nil, fmt.Errorf("invalid chain signature")
-		}
-
 		return true, hPubk, nil
 
 	default:
-		return false, nil, fmt.Errorf("unsupported issuer format")
+		return false, nil, errMalformedChainData("unsupported issuer format")
 	}
 }
@@ -287,6 +287,57 @@ var _ = Describe("StandardClaims", func() {
 		})
 	})
 
+	Describe("Key pairs", func() {
+		var client *ClientIDClaims
+
+		BeforeEach(func() {
+			client, err = NewClientIDClaims("up=ginkgo", nil, "", nil, "", "", time.Hour, nil, readEd25519PublicKeyFile("testdata/ed25519/signer.public"))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should match client tokens against seeds and private keys", func() {
+			for _, f := range []string{"testdata/ed25519/signer.seed", "testdata/ed25519/signer-key.pem"} {
+				match, err := client.IsMatchingPrivateKeyFile(f)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(match).To(BeTrue())
+				Expect(client.VerifyKeyPairFile(f)).To(Succeed())
+			}
+
+			match, err := client.IsMatchingSeedFile("testdata/ed25519/signer.seed")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(match).To(BeTrue())
+
+			match, err = client.IsMatchingPrivateKeyFile("testdata/ed25519/other.seed")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(match).To(BeFalse())
+			Expect(client.VerifyKeyPairFile("testdata/ed25519/other.seed")).To(MatchError(fmt.Sprintf("token public key %s does not match private key testdata/ed25519/other.seed", client.PublicKey)))
+		})
+
+		It("Should match OpenSSH keys", func() {
+			client.PublicKey = hex.EncodeToString(readEd25519PublicKeyFile("testdata/ed25519/openssh.public"))
+			Expect(client.VerifyKeyPairFile("testdata/ed25519/openssh.key")).To(Succeed())
+			Expect(client.VerifyKeyPairFile("testdata/ed25519/signer.seed")).To(HaveOccurred())
+
+			err := client.VerifyKeyPairFile("testdata/ed25519/openssh-encrypted.key")
+			Expect(err).To(MatchError("could not compare token public key to private key testdata/ed25519/openssh-encrypted.key: could not parse signing key: encrypted openssh keys are not supported"))
+		})
+
+		It("Should match chain issuers", func() {
+			_, orgPriK, err := iu.Ed25519KeyPair()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.AddOrgIssuerData(mustSigner(orgPriK))).To(Succeed())
+			Expect(client.VerifyKeyPairFile("testdata/ed25519/signer-key.pem")).To(Succeed())
+		})
+
+		It("Should reject non ed25519 keys", func() {
+			_, err := client.IsMatchingPrivateKeyFile("testdata/rsa/signer-key.pem")
+			Expect(err).To(MatchError("testdata/rsa/signer-key.pem does not hold an ed25519 private key"))
+
+			client.PublicKey = ""
+			Expect(client.VerifyKeyPairFile("testdata/ed25519/signer.seed")).To(MatchError("could not compare token public key to private key testdata/ed25519/signer.seed: no public key stored in the JWT"))
+		})
+	})
+
 	Describe("Organization Issuer", func() {
 		Describe("IsSignedByIssuer", func() {
 			It("Should expect minimally correct data", func() {
@@ -296,7 +347,7 @@ var _ = Describe("StandardClaims", func() {
 						Fail(fmt.Sprintf("Expected to be ok but got %v", err))
 					}
 
-					Expect(err).To(MatchError(expect))
+					Expect(err).To(MatchError(expect.Error()))
 					Expect(ok).To(BeFalse())
 				}
 
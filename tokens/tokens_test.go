@@ -5,6 +5,8 @@
 package tokens
 
 import (
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/rsa"
 	"encoding/hex"
@@ -13,6 +15,7 @@ import (
 	"runtime"
 	"time"
 
+	iu "github.com/choria-io/go-choria/internal/util"
 	"github.com/golang-jwt/jwt/v4"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -47,6 +50,52 @@ func loadRSAPriKey(k string) *rsa.PrivateKey {
 	return pK
 }
 
+func loadECDSAPubKey(k string) *ecdsa.PublicKey {
+	f, err := os.ReadFile(k)
+	Expect(err).ToNot(HaveOccurred())
+	pubK, err := jwt.ParseECPublicKeyFromPEM(f)
+	Expect(err).ToNot(HaveOccurred())
+	return pubK
+}
+
+func readEd25519PublicKeyFile(f string) ed25519.PublicKey {
+	dat, err := os.ReadFile(f)
+	Expect(err).ToNot(HaveOccurred())
+	pubK, err := hex.DecodeString(string(dat))
+	Expect(err).ToNot(HaveOccurred())
+	return pubK
+}
+
+func mustSigner(pk crypto.PrivateKey) Signer {
+	signer, err := NewKeySigner(pk)
+	Expect(err).ToNot(HaveOccurred())
+	return signer
+}
+
+// newTestClient creates claims for caller holding a new ed25519 public key, returning the claims and matching private key
+func newTestClient(caller string, validity time.Duration, agents ...string) (*ClientIDClaims, ed25519.PrivateKey) {
+	pubK, priK, err := iu.Ed25519KeyPair()
+	Expect(err).ToNot(HaveOccurred())
+
+	claims, err := NewClientIDClaims(caller, agents, "", nil, "", "", validity, nil, pubK)
+	Expect(err).ToNot(HaveOccurred())
+
+	return claims, priK
+}
+
+// newTestClientToken creates a client token in the organization unit ou signed by signer
+func newTestClientToken(ou string, signer Signer) string {
+	claims, _ := newTestClient("up=ginkgo", time.Hour)
+	if ou != "" {
+		claims.OrganizationUnit = ou
+	}
+
+	t, err := SignToken(claims, signer)
+	Expect(err).ToNot(HaveOccurred())
+
+	return t
+}
+
 var _ = Describe("Tokens", func() {
 	var (
 		provJWTRSA     []byte
@@ -125,7 +174,7 @@ var _ = Describe("Tokens", func() {
 
 				pubK, priK := loadEd25519Seed("testdata/ed25519/signer.seed")
 
-				t, err := SignToken(claims, priK)
+				t, err := SignToken(claims, mustSigner(priK))
 				Expect(err).ToNot(HaveOccurred())
 
 				claims = &StandardClaims{}
@@ -143,7 +192,7 @@ var _ = Describe("Tokens", func() {
 			It("Should correctly sign the token", func() {
 				claims, err := newStandardClaims("ginkgo", ProvisioningPurpose, 0, false)
 				Expect(err).ToNot(HaveOccurred())
-				t, err := SignToken(claims, loadRSAPriKey("testdata/rsa/signer-key.pem"))
+				t, err := SignToken(claims, mustSigner(loadRSAPriKey("testdata/rsa/signer-key.pem")))
 				Expect(err).ToNot(HaveOccurred())
 
 				pubK, _ := loadEd25519Seed("testdata/ed25519/signer.seed")
@@ -191,6 +240,106 @@ var _ = Describe("Tokens", func() {
 		})
 	})
 
+	Describe("RSA Algorithms", func() {
+		It("Should sign and verify using all supported algorithms", func() {
+			for _, alg := range []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"} {
+				claims, err := newStandardClaims("ginkgo", ProvisioningPurpose, 0, false)
+				Expect(err).ToNot(HaveOccurred())
+
+				t, err := SignTokenWithKeyFile(claims, "testdata/rsa/signer-key.pem", WithSigningAlgorithm(alg))
+				Expect(err).ToNot(HaveOccurred())
+				token, _, err := new(jwt.Parser).ParseUnverified(t, &StandardClaims{})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(token.Method.Alg()).To(Equal(alg))
+
+				err = ParseToken(t, &StandardClaims{}, loadRSAPubKey("testdata/rsa/other-public.pem"))
+				Expect(err).To(HaveOccurred())
+
+				claims = &StandardClaims{}
+				err = ParseToken(t, claims, loadRSAPubKey("testdata/rsa/signer-public.pem"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(claims.Issuer).To(Equal("ginkgo"))
+			}
+		})
+
+		It("Should only allow rsa algorithms", func() {
+			claims, err := newStandardClaims("ginkgo", ProvisioningPurpose, 0, false)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = SignTokenWithKeyFile(claims, "testdata/rsa/signer-key.pem", WithSigningAlgorithm("EdDSA"))
+			Expect(err).To(MatchError("unsupported signing algorithm EdDSA for rsa keys"))
+
+			_, err = SignTokenWithKeyFile(claims, "testdata/rsa/signer-key.pem", WithSigningAlgorithm("XX256"))
+			Expect(err).To(MatchError(`unknown signing algorithm "XX256"`))
+
+			_, err = SignTokenWithKeyFile(claims, "testdata/ed25519/signer.seed", WithSigningAlgorithm("PS256"))
+			Expect(err).To(MatchError("unsupported signing algorithm PS256 for EdDSA keys"))
+		})
+	})
+
+	Describe("ECDSA", func() {
+		It("Should sign and verify P-256 tokens", func() {
+			claims, err := newStandardClaims("ginkgo", ProvisioningPurpose, 0, false)
+			Expect(err).ToNot(HaveOccurred())
+
+			t, err := SignTokenWithKeyFile(claims, "testdata/ecdsa/signer-key.pem")
+			Expect(err).ToNot(HaveOccurred())
+			token, _, err := new(jwt.Parser).ParseUnverified(t, &StandardClaims{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(token.Method.Alg()).To(Equal("ES256"))
+
+			claims = &StandardClaims{}
+			err = ParseToken(t, claims, loadRSAPubKey("testdata/rsa/signer-public.pem"))
+			Expect(err).To(MatchError("ecdsa public key required"))
+
+			err = ParseToken(t, claims, loadECDSAPubKey("testdata/ecdsa/other-public.pem"))
+			Expect(err).To(MatchError("crypto/ecdsa: verification error"))
+
+			err = ParseToken(t, claims, loadECDSAPubKey("testdata/ecdsa/signer-public.pem"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(claims.Issuer).To(Equal("ginkgo"))
+		})
+
+		It("Should sign and verify P-384 tokens", func() {
+			claims, err := newStandardClaims("ginkgo", ProvisioningPurpose, 0, false)
+			Expect(err).ToNot(HaveOccurred())
+
+			t, err := SignTokenWithKeyFile(claims, "testdata/ecdsa/p384-key.pem")
+			Expect(err).ToNot(HaveOccurred())
+			token, _, err := new(jwt.Parser).ParseUnverified(t, &StandardClaims{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(token.Method.Alg()).To(Equal("ES384"))
+
+			claims = &StandardClaims{}
+			err = ParseToken(t, claims, loadECDSAPubKey("testdata/ecdsa/p384-public.pem"))
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Describe("readPublicKeyData", func() {
+		It("Should read all supported formats", func() {
+			for _, f := range []string{"testdata/ecdsa/signer-public.pem", "testdata/ecdsa/signer-cert.pem", "testdata/ecdsa/p384-public.pem"} {
+				dat, err := os.ReadFile(f)
+				Expect(err).ToNot(HaveOccurred())
+				pk, err := readPublicKeyData(dat)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(pk).To(BeAssignableToTypeOf(&ecdsa.PublicKey{}))
+			}
+
+			dat, err := os.ReadFile("testdata/rsa/signer-public.pem")
+			Expect(err).ToNot(HaveOccurred())
+			pk, err := readPublicKeyData(dat)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pk).To(Equal(loadRSAPubKey("testdata/rsa/signer-public.pem")))
+
+			dat, err = os.ReadFile("testdata/ed25519/signer.public")
+			Expect(err).ToNot(HaveOccurred())
+			pk, err = readPublicKeyData(dat)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pk).To(BeAssignableToTypeOf(ed25519.PublicKey{}))
+		})
+	})
+
 	Describe("SaveAndSignTokenWithKeyFile", func() {
 		var td string
 		var err error
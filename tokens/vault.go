@@ -0,0 +1,241 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+const vaultSigPrefix = "vault:v"
+
+type vaultSigner struct {
+	ctx    context.Context
+	key    string
+	token  string
+	addr   string
+	kid    string
+	derive bool
+	client *http.Client
+	pub    ed25519.PublicKey
+	ver    int64
+	log    *logrus.Entry
+	mu     sync.Mutex
+}
+
+// NewVaultSigner creates a Signer that signs using the named ed25519 key in a Vault Transit engine.  Requires VAULT_TOKEN and VAULT_ADDR to be set.
+//
+// Once the public key was fetched using Public all signatures are made using that version of the key so that they
+// match the public key even after the key is rotated in Vault, a nil log discards log messages.
+func NewVaultSigner(ctx context.Context, key string, tlsc *tls.Config, log *logrus.Entry, opts ...SignerOption) (Signer, error) {
+	sopts := &signerOpts{}
+	for _, opt := range opts {
+		err := opt(sopts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if sopts.alg != "" && sopts.alg != algEdDSA {
+		return nil, fmt.Errorf("unsupported signing algorithm %s for vault keys", sopts.alg)
+	}
+
+	vt := os.Getenv("VAULT_TOKEN")
+	va := os.Getenv("VAULT_ADDR")
+
+	if vt == "" || va == "" {
+		return nil, fmt.Errorf("requires VAULT_TOKEN and VAULT_ADDR environment variables")
+	}
+
+	if key == "" {
+		return nil, fmt.Errorf("key name is required")
+	}
+
+	if log == nil {
+		logger := logrus.New()
+		logger.SetOutput(io.Discard)
+		log = logrus.NewEntry(logger)
+	}
+
+	client := &http.Client{}
+	if tlsc != nil {
+		client.Transport = &http.Transport{TLSClientConfig: tlsc}
+	}
+
+	return &vaultSigner{
+		ctx:    ctx,
+		key:    key,
+		token:  vt,
+		addr:   va,
+		kid:    sopts.kid,
+		derive: sopts.deriveKid,
+		client: client,
+		log:    log,
+	}, nil
+}
+
+func (s *vaultSigner) Algorithm() string { return algEdDSA }
+
+// KeyID is the configured key id or, when requested using WithDerivedKeyID, the PublicKeyID of the Vault key
+func (s *vaultSigner) KeyID() string {
+	s.mu.Lock()
+	kid, derive := s.kid, s.derive
+	s.mu.Unlock()
+
+	if kid != "" || !derive {
+		return kid
+	}
+
+	pub := s.Public()
+	if pub == nil {
+		return ""
+	}
+
+	kid, err := PublicKeyID(pub)
+	if err != nil {
+		return ""
+	}
+
+	s.mu.Lock()
+	s.kid = kid
+	s.mu.Unlock()
+
+	return kid
+}
+
+// Public fetches the public key of the latest version of the key from Vault and pins signing to that version, nil on failure
+func (s *vaultSigner) Public() crypto.PublicKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pub != nil {
+		return s.pub
+	}
+
+	body, err := s.request("GET", fmt.Sprintf("/v1/transit/keys/%s", s.key), nil)
+	if err != nil {
+		s.log.Errorf("Could not retrieve public key %s from Vault: %v", s.key, err)
+		return nil
+	}
+
+	ver := gjson.GetBytes(body, "data.latest_version").Int()
+	pks := gjson.GetBytes(body, fmt.Sprintf("data.keys.%d.public_key", ver))
+	if !pks.Exists() {
+		s.log.Errorf("No public key for version %d of %s in Vault response", ver, s.key)
+		return nil
+	}
+
+	pk, err := base64.StdEncoding.DecodeString(pks.String())
+	if err != nil || len(pk) != ed25519.PublicKeySize {
+		s.log.Errorf("Invalid ed25519 public key %s received from Vault", s.key)
+		return nil
+	}
+
+	s.pub = pk
+	s.ver = ver
+
+	return s.pub
+}
+
+func (s *vaultSigner) Sign(data []byte) ([]byte, error) {
+	dat := map[string]any{
+		"signature_algorithm": "ed25519",
+		"input":               base64.StdEncoding.EncodeToString(data),
+	}
+
+	s.mu.Lock()
+	ver := s.ver
+	s.mu.Unlock()
+
+	// sign using the version of the key Public returned
+	if ver > 0 {
+		dat["key_version"] = ver
+	}
+
+	jdat, err := json.Marshal(dat)
+	if err != nil {
+		return nil, err
+	}
+	s.log.Debugf("JSON Request: %s", string(jdat))
+
+	body, err := s.request("POST", fmt.Sprintf("/v1/transit/sign/%s", s.key), jdat)
+	if err != nil {
+		return nil, err
+	}
+
+	sig := gjson.GetBytes(body, "data.signature")
+	if !sig.Exists() {
+		return nil, fmt.Errorf("no signature in response: %s", string(body))
+	}
+
+	// signatures are in vault:v<version>:<signature> format
+	sigs := sig.String()
+	if !strings.HasPrefix(sigs, vaultSigPrefix) {
+		return nil, fmt.Errorf("invalid signature, no vault:v prefix")
+	}
+
+	sigver, sigb64, ok := strings.Cut(strings.TrimPrefix(sigs, vaultSigPrefix), ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid signature, no key version")
+	}
+
+	if ver > 0 && sigver != strconv.FormatInt(ver, 10) {
+		return nil, fmt.Errorf("signed using version %s of %s while version %d was requested", sigver, s.key, ver)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(sigb64)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode vault response: %w", err)
+	}
+
+	return signature, nil
+}
+
+func (s *vaultSigner) request(method string, path string, body []byte) ([]byte, error) {
+	uri, err := url.Parse(s.addr)
+	if err != nil {
+		return nil, err
+	}
+	uri.Path = path
+
+	req, err := http.NewRequestWithContext(s.ctx, method, uri.String(), bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("X-Vault-Token", s.token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	rbody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("request failed: code: %d: %s", resp.StatusCode, string(rbody))
+	}
+
+	return rbody, nil
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+var _ = Describe("VaultSigner", func() {
+	var (
+		srv    *httptest.Server
+		gets   int
+		latest int
+		keys   map[int]ed25519.PrivateKey
+		pubK   ed25519.PublicKey
+		priK   ed25519.PrivateKey
+		log    *logrus.Entry
+	)
+
+	BeforeEach(func() {
+		pubK, priK = loadEd25519Seed("testdata/ed25519/signer.seed")
+		gets = 0
+		latest = 1
+		keys = map[int]ed25519.PrivateKey{1: priK}
+		log = logrus.NewEntry(logrus.New())
+		log.Logger.SetOutput(GinkgoWriter)
+
+		srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Vault-Token") != "ginkgo" {
+				w.WriteHeader(403)
+				return
+			}
+
+			switch {
+			case r.Method == "GET" && r.URL.Path == "/v1/transit/keys/signer":
+				gets++
+				pub := keys[latest].Public().(ed25519.PublicKey)
+				fmt.Fprintf(w, `{"data":{"latest_version":%d,"keys":{"%d":{"public_key":%q}}}}`, latest, latest, base64.StdEncoding.EncodeToString(pub))
+
+			case r.Method == "POST" && r.URL.Path == "/v1/transit/sign/signer":
+				body, _ := io.ReadAll(r.Body)
+				input, _ := base64.StdEncoding.DecodeString(gjson.GetBytes(body, "input").String())
+				ver := latest
+				if v := gjson.GetBytes(body, "key_version"); v.Exists() {
+					ver = int(v.Int())
+				}
+				sig := ed25519.Sign(keys[ver], input)
+				fmt.Fprintf(w, `{"data":{"signature":"vault:v%d:%s"}}`, ver, base64.StdEncoding.EncodeToString(sig))
+
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+
+		os.Setenv("VAULT_ADDR", srv.URL)
+		os.Setenv("VAULT_TOKEN", "ginkgo")
+	})
+
+	AfterEach(func() {
+		srv.Close()
+		os.Unsetenv("VAULT_ADDR")
+		os.Unsetenv("VAULT_TOKEN")
+	})
+
+	It("Should require the vault environment", func() {
+		os.Unsetenv("VAULT_TOKEN")
+		_, err := NewVaultSigner(context.Background(), "signer", nil, log)
+		Expect(err).To(MatchError("requires VAULT_TOKEN and VAULT_ADDR environment variables"))
+	})
+
+	It("Should fetch the public key", func() {
+		signer, err := NewVaultSigner(context.Background(), "signer", nil, log)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(signer.Public()).To(Equal(pubK))
+
+		signer, err = NewVaultSigner(context.Background(), "other", nil, log)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(signer.Public()).To(BeNil())
+	})
+
+	It("Should sign tokens", func() {
+		signer, err := NewVaultSigner(context.Background(), "signer", nil, log)
+		Expect(err).ToNot(HaveOccurred())
+
+		claims, err := newStandardClaims("ginkgo", ProvisioningPurpose, 0, false)
+		Expect(err).ToNot(HaveOccurred())
+
+		t, err := SignToken(claims, signer)
+		Expect(err).ToNot(HaveOccurred())
+
+		claims = &StandardClaims{}
+		Expect(ParseToken(t, claims, pubK)).To(Succeed())
+		Expect(claims.Issuer).To(Equal("ginkgo"))
+	})
+
+	It("Should only derive key ids when requested", func() {
+		claims, err := newStandardClaims("ginkgo", ProvisioningPurpose, 0, false)
+		Expect(err).ToNot(HaveOccurred())
+
+		signer, err := NewVaultSigner(context.Background(), "signer", nil, log)
+		Expect(err).ToNot(HaveOccurred())
+		t, err := SignToken(claims, signer)
+		Expect(err).ToNot(HaveOccurred())
+		parsed, err := NewParsedToken(t)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(parsed.d.token.Header).ToNot(HaveKey("kid"))
+		Expect(gets).To(Equal(0))
+
+		kid, err := PublicKeyID(pubK)
+		Expect(err).ToNot(HaveOccurred())
+
+		signer, err = NewVaultSigner(context.Background(), "signer", nil, log, WithDerivedKeyID())
+		Expect(err).ToNot(HaveOccurred())
+		for i := 0; i < 2; i++ {
+			t, err = SignToken(claims, signer)
+			Expect(err).ToNot(HaveOccurred())
+			parsed, err = NewParsedToken(t)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed.d.token.Header["kid"]).To(Equal(kid))
+		}
+		Expect(gets).To(Equal(1))
+	})
+
+	It("Should keep signing using the version of the public key after rotation", func() {
+		signer, err := NewVaultSigner(context.Background(), "signer", nil, log)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(signer.Public()).To(Equal(pubK))
+
+		_, rotated := loadEd25519Seed("testdata/ed25519/other.seed")
+		keys[2] = rotated
+		latest = 2
+
+		claims, err := newStandardClaims("ginkgo", ProvisioningPurpose, 0, false)
+		Expect(err).ToNot(HaveOccurred())
+		t, err := SignToken(claims, signer)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ParseToken(t, &StandardClaims{}, signer.Public())).To(Succeed())
+
+		signer, err = NewVaultSigner(context.Background(), "signer", nil, log)
+		Expect(err).ToNot(HaveOccurred())
+		t, err = SignToken(claims, signer)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ParseToken(t, &StandardClaims{}, rotated.Public())).To(Succeed())
+	})
+
+	It("Should not require a logger", func() {
+		signer, err := NewVaultSigner(context.Background(), "other", nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(signer.Public()).To(BeNil())
+	})
+
+	It("Should save signed tokens", func() {
+		td := GinkgoT().TempDir()
+		out := filepath.Join(td, "token.jwt")
+
+		claims, err := newStandardClaims("ginkgo", ProvisioningPurpose, 0, false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(SaveAndSignTokenWithVault(context.Background(), claims, "signer", out, 0600, nil, log)).To(Succeed())
+
+		t, err := os.ReadFile(out)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ParseToken(string(t), &StandardClaims{}, pubK)).To(Succeed())
+	})
+
+	It("Should handle vault failures", func() {
+		signer, err := NewVaultSigner(context.Background(), "other", nil, log)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = signer.Sign([]byte("x"))
+		Expect(err).To(MatchError("request failed: code: 404: "))
+	})
+})
@@ -0,0 +1,410 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Verifier verifies tokens against a set of trusted keys using a reusable set of validation options
+type Verifier struct {
+	keys           *Keyring
+	federation     *Federation
+	store          *TrustStore
+	leeway         time.Duration
+	clock          func() time.Time
+	algorithms     []string
+	audience       string
+	issuer         string
+	enforcePurpose bool
+	revocations    *RevocationListClaims
+	parseOpts      []ParseOption
+	mu             sync.Mutex
+}
+
+// VerifierOption configures a Verifier
+type VerifierOption func(*Verifier) error
+
+// WithTrustedKeys adds public keys to the keys tokens will be verified against
+func WithTrustedKeys(keys ...crypto.PublicKey) VerifierOption {
+	return func(v *Verifier) error {
+		for _, key := range keys {
+			err := v.keys.Add(key)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// WithTrustedKeyFiles adds public keys stored in files to the keys tokens will be verified against
+func WithTrustedKeyFiles(files ...string) VerifierOption {
+	return func(v *Verifier) error {
+		for _, file := range files {
+			err := v.keys.AddFile(file)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// WithKeyring verifies tokens against the keys in keyring, changes to the keyring will be used by the verifier.
+//
+// This replaces the keyring of the verifier, keys added using WithTrustedKeys or WithTrustedKeyFiles after this
+// option will be added to keyring
+func WithKeyring(keyring *Keyring) VerifierOption {
+	return func(v *Verifier) error {
+		if keyring == nil {
+			return fmt.Errorf("keyring is required")
+		}
+
+		v.keys = keyring
+		return nil
+	}
+}
+
+// WithFederation verifies tokens against the keys trusted for the organization unit they claim, changes to the
+// federation will be used by the verifier. This can not be combined with trusted keys or a keyring.
+func WithFederation(federation *Federation) VerifierOption {
+	return func(v *Verifier) error {
+		if federation == nil {
+			return fmt.Errorf("federation is required")
+		}
+
+		v.federation = federation
+		return nil
+	}
+}
+
+// WithTrustStore verifies tokens against the active anchors in store, reloads of the store will be used by the
+// verifier. This can not be combined with trusted keys, a keyring or a federation.
+func WithTrustStore(store *TrustStore) VerifierOption {
+	return func(v *Verifier) error {
+		if store == nil {
+			return fmt.Errorf("trust store is required")
+		}
+
+		v.store = store
+		return nil
+	}
+}
+
+// WithLeeway allows for clock skew when checking token expiry, not before and issued at times
+func WithLeeway(leeway time.Duration) VerifierOption {
+	return func(v *Verifier) error {
+		if leeway < 0 {
+			return fmt.Errorf("leeway can not be negative")
+		}
+
+		v.leeway = leeway
+		return nil
+	}
+}
+
+// WithClock sets the function used to determine the current time, defaults to time.Now
+func WithClock(clock func() time.Time) VerifierOption {
+	return func(v *Verifier) error {
+		if clock == nil {
+			return fmt.Errorf("clock is required")
+		}
+
+		v.clock = clock
+		return nil
+	}
+}
+
+// WithAllowedAlgorithms restricts the signing algorithms that will be accepted
+func WithAllowedAlgorithms(algs ...string) VerifierOption {
+	return func(v *Verifier) error {
+		if len(algs) == 0 {
+			return fmt.Errorf("at least one algorithm is required")
+		}
+
+		for _, alg := range algs {
+			if !isValidMethod(alg) {
+				return fmt.Errorf("unsupported signing algorithm %q", alg)
+			}
+		}
+
+		v.algorithms = algs
+		return nil
+	}
+}
+
+// WithRequiredAudience requires tokens to have aud as one of their audiences
+func WithRequiredAudience(aud string) VerifierOption {
+	return func(v *Verifier) error {
+		v.audience = aud
+		return nil
+	}
+}
+
+// WithRequiredIssuer requires tokens to have iss as issuer
+func WithRequiredIssuer(iss string) VerifierOption {
+	return func(v *Verifier) error {
+		v.issuer = iss
+		return nil
+	}
+}
+
+// WithPurposeEnforcement determines if the purpose of tokens should be checked by the typed Verify methods, defaults to true
+func WithPurposeEnforcement(enforce bool) VerifierOption {
+	return func(v *Verifier) error {
+		v.enforcePurpose = enforce
+		return nil
+	}
+}
+
+// WithRevocationList rejects tokens that are revoked in list, see SetRevocationList to update the list later
+func WithRevocationList(list *RevocationListClaims) VerifierOption {
+	return func(v *Verifier) error {
+		if list == nil {
+			return fmt.Errorf("revocation list is required")
+		}
+
+		v.revocations = list
+		return nil
+	}
+}
+
+// WithParseOptions sets options used when verifying tokens and their trust chains, like WithMaxChainDepth
+func WithParseOptions(opts ...ParseOption) VerifierOption {
+	return func(v *Verifier) error {
+		v.parseOpts = append(v.parseOpts, opts...)
+		return nil
+	}
+}
+
+// NewVerifier creates a new Verifier, at least one trusted key, a federation or a trust store is required
+func NewVerifier(opts ...VerifierOption) (*Verifier, error) {
+	v := &Verifier{
+		keys:           &Keyring{},
+		clock:          time.Now,
+		algorithms:     validMethods,
+		enforcePurpose: true,
+	}
+
+	for _, opt := range opts {
+		err := opt(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case v.federation != nil && v.keys.Len() > 0:
+		return nil, fmt.Errorf("trusted keys can not be combined with a federation")
+	case v.store != nil && v.keys.Len() > 0:
+		return nil, fmt.Errorf("trusted keys can not be combined with a trust store")
+	case v.store != nil && v.federation != nil:
+		return nil, fmt.Errorf("a federation can not be combined with a trust store")
+	case v.federation == nil && v.store == nil && v.keys.Len() == 0:
+		return nil, fmt.Errorf("no trusted keys configured")
+	}
+
+	return v, nil
+}
+
+// Verify parses token into claims and verifies it, claims must embed StandardClaims
+func (v *Verifier) Verify(token string, claims jwt.Claims) error {
+	sc, ok := claims.(Claims)
+	if !ok {
+		return fmt.Errorf("unsupported claims type %T", claims)
+	}
+
+	d, err := decodeToken(token)
+	if err != nil {
+		return err
+	}
+
+	err = d.decodeClaims(claims)
+	if err != nil {
+		return err
+	}
+
+	return v.verifyDecoded(d, sc)
+}
+
+// verifyDecoded verifies a decoded token using the trust configured in the verifier
+func (v *Verifier) verifyDecoded(d *decodedToken, sc Claims) error {
+	opts := newParseOpts(v.parseOpts)
+	opts.now = v.clock
+	opts.methods = v.algorithms
+	opts.skipValidation = true
+
+	var trust any
+	switch {
+	case v.store != nil:
+		trust = v.store
+	case v.federation != nil:
+		trust = v.federation
+	default:
+		trust = v.keys
+	}
+
+	err := verifyDecodedSignature(d, trust, opts)
+	if err != nil {
+		return err
+	}
+
+	err = v.validateClaims(sc.standardClaims())
+	if err != nil {
+		return err
+	}
+
+	err = v.checkRevoked(sc.standardClaims(), opts)
+	if err != nil {
+		if opts.cache != nil {
+			opts.cache.remove(tokenHash(d.token.Raw))
+		}
+		return err
+	}
+
+	if def := purposeForClaims(sc); def != nil && def.Verified != nil {
+		return def.Verified(sc)
+	}
+
+	return nil
+}
+
+// SetRevocationList replaces the revocation list used by the verifier, nil disables revocation checks, a
+// verification cache set using WithParseOptions is purged
+func (v *Verifier) SetRevocationList(list *RevocationListClaims) {
+	v.mu.Lock()
+	v.revocations = list
+	v.mu.Unlock()
+
+	if cache := newParseOpts(v.parseOpts).cache; cache != nil {
+		cache.Purge()
+	}
+}
+
+// checkRevoked checks c against the revocation list of the verifier and one set using WithParseOptions
+func (v *Verifier) checkRevoked(c *StandardClaims, opts *parseOpts) error {
+	v.mu.Lock()
+	list := v.revocations
+	v.mu.Unlock()
+
+	for _, list := range []*RevocationListClaims{list, opts.revocations} {
+		if list == nil {
+			continue
+		}
+
+		err := list.checkCurrent(v.clock())
+		if err != nil {
+			return err
+		}
+
+		err = list.CheckRevoked(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// VerifyClient verifies a client id token
+func (v *Verifier) VerifyClient(token string) (*ClientIDClaims, error) {
+	claims := &ClientIDClaims{}
+	err := v.Verify(token, claims)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse client id token: %w", err)
+	}
+
+	if v.enforcePurpose && !IsClientIDToken(claims.StandardClaims) {
+		return nil, ErrNotAClientToken
+	}
+
+	return claims, nil
+}
+
+// VerifyServer verifies a server token
+func (v *Verifier) VerifyServer(token string) (*ServerClaims, error) {
+	claims := &ServerClaims{}
+	err := v.Verify(token, claims)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse server id token: %w", err)
+	}
+
+	if v.enforcePurpose && !IsServerToken(claims.StandardClaims) {
+		return nil, ErrNotAServerToken
+	}
+
+	return claims, nil
+}
+
+// VerifyProvisioning verifies a provisioning token
+func (v *Verifier) VerifyProvisioning(token string) (*ProvisioningClaims, error) {
+	claims := &ProvisioningClaims{}
+	err := v.Verify(token, claims)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse provisioner token: %w", err)
+	}
+
+	if v.enforcePurpose && !IsProvisioningToken(claims.StandardClaims) {
+		return nil, ErrNotAProvisioningToken
+	}
+
+	if claims.OrganizationUnit == "" {
+		claims.OrganizationUnit = defaultOrg
+	}
+
+	return claims, nil
+}
+
+func (v *Verifier) validateClaims(c *StandardClaims) error {
+	now := v.clock()
+
+	if c.ExpiresAt != nil && now.Add(-v.leeway).After(c.ExpiresAt.Time) {
+		return fmt.Errorf("%w by %v", jwt.ErrTokenExpired, now.Sub(c.ExpiresAt.Time))
+	}
+
+	if c.NotBefore != nil && now.Add(v.leeway).Before(c.NotBefore.Time) {
+		return jwt.ErrTokenNotValidYet
+	}
+
+	if c.IssuedAt != nil && now.Add(v.leeway).Before(c.IssuedAt.Time) {
+		return jwt.ErrTokenUsedBeforeIssued
+	}
+
+	// tokens issued by a chain issuer must have an issuer expiry that has not passed
+	if c.TrustChainSignature != "" && strings.HasPrefix(c.Issuer, ChainIssuerPrefix) {
+		if c.IssuerExpiresAt == nil || now.Add(-v.leeway).After(c.IssuerExpiresAt.Time) {
+			return errIssuerExpired
+		}
+	}
+
+	if v.audience != "" && !c.VerifyAudience(v.audience, true) {
+		return jwt.ErrTokenInvalidAudience
+	}
+
+	if v.issuer != "" && c.Issuer != v.issuer {
+		return jwt.ErrTokenInvalidIssuer
+	}
+
+	return nil
+}
+
+func isValidMethod(alg string) bool {
+	for _, m := range validMethods {
+		if m == alg {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2022, R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tokens
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Verifier", func() {
+	var (
+		now    time.Time
+		pubK   ed25519.PublicKey
+		client *ClientIDClaims
+		err    error
+	)
+
+	BeforeEach(func() {
+		now = time.Now()
+		pubK, _ = loadEd25519Seed("testdata/ed25519/other.seed")
+		client, err = NewClientIDClaims("up=ginkgo", nil, "", nil, "", "ginkgo", time.Hour, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Describe("NewVerifier", func() {
+		It("Should require keys", func() {
+			_, err := NewVerifier()
+			Expect(err).To(MatchError("no trusted keys configured"))
+		})
+
+		It("Should validate options", func() {
+			_, err := NewVerifier(WithTrustedKeyFiles("testdata/rsa/signer-public.pem"), WithAllowedAlgorithms("HS256"))
+			Expect(err).To(MatchError(`unsupported signing algorithm "HS256"`))
+
+			_, err = NewVerifier(WithTrustedKeyFiles("testdata/rsa/signer-public.pem"), WithLeeway(-1))
+			Expect(err).To(MatchError("leeway can not be negative"))
+		})
+	})
+
+	Describe("VerifyClient", func() {
+		It("Should verify against any trusted key", func() {
+			v, err := NewVerifier(WithTrustedKeys(pubK), WithTrustedKeyFiles("testdata/rsa/signer-public.pem"))
+			Expect(err).ToNot(HaveOccurred())
+
+			t, err := SignTokenWithKeyFile(client, "testdata/rsa/signer-key.pem")
+			Expect(err).ToNot(HaveOccurred())
+
+			parsed, err := v.VerifyClient(t)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed.CallerID).To(Equal("up=ginkgo"))
+
+			t, err = SignTokenWithKeyFile(client, "testdata/ed25519/signer.seed")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = v.VerifyClient(t)
+			Expect(err).To(MatchError("could not parse client id token: ed25519: verification error"))
+		})
+
+		It("Should enforce the purpose", func() {
+			prov, err := NewProvisioningClaims(true, true, "x", "", "", []string{"nats://localhost:4222"}, "", "", "", "", "", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			t, err := SignTokenWithKeyFile(prov, "testdata/rsa/signer-key.pem")
+			Expect(err).ToNot(HaveOccurred())
+
+			v, err := NewVerifier(WithTrustedKeyFiles("testdata/rsa/signer-public.pem"))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = v.VerifyClient(t)
+			Expect(err).To(MatchError(ErrNotAClientToken))
+
+			v, err = NewVerifier(WithTrustedKeyFiles("testdata/rsa/signer-public.pem"), WithPurposeEnforcement(false))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = v.VerifyClient(t)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = v.VerifyProvisioning(t)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should support clock skew", func() {
+			client.ExpiresAt = jwt.NewNumericDate(now.Add(-30 * time.Second))
+			t, err := SignTokenWithKeyFile(client, "testdata/rsa/signer-key.pem")
+			Expect(err).ToNot(HaveOccurred())
+
+			v, err := NewVerifier(WithTrustedKeyFiles("testdata/rsa/signer-public.pem"))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = v.VerifyClient(t)
+			Expect(err).To(MatchError(jwt.ErrTokenExpired))
+
+			v, err = NewVerifier(WithTrustedKeyFiles("testdata/rsa/signer-public.pem"), WithLeeway(time.Minute))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = v.VerifyClient(t)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should use the clock", func() {
+			t, err := SignTokenWithKeyFile(client, "testdata/rsa/signer-key.pem")
+			Expect(err).ToNot(HaveOccurred())
+
+			v, err := NewVerifier(WithTrustedKeyFiles("testdata/rsa/signer-public.pem"), WithClock(func() time.Time { return now.Add(2 * time.Hour) }))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = v.VerifyClient(t)
+			Expect(err).To(MatchError(jwt.ErrTokenExpired))
+
+			v, err = NewVerifier(WithTrustedKeyFiles("testdata/rsa/signer-public.pem"), WithClock(func() time.Time { return now.Add(-time.Hour) }))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = v.VerifyClient(t)
+			Expect(err).To(MatchError(jwt.ErrTokenNotValidYet))
+		})
+
+		It("Should restrict algorithms", func() {
+			t, err := SignTokenWithKeyFile(client, "testdata/rsa/signer-key.pem")
+			Expect(err).ToNot(HaveOccurred())
+
+			v, err := NewVerifier(WithTrustedKeyFiles("testdata/rsa/signer-public.pem"), WithAllowedAlgorithms("PS256"))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = v.VerifyClient(t)
+			Expect(err).To(MatchError("could not parse client id token: signing method RS256 is invalid"))
+		})
+
+		It("Should check audience and issuer", func() {
+			client.Audience = jwt.ClaimStrings{"choria"}
+			t, err := SignTokenWithKeyFile(client, "testdata/rsa/signer-key.pem")
+			Expect(err).ToNot(HaveOccurred())
+
+			v, err := NewVerifier(WithTrustedKeyFiles("testdata/rsa/signer-public.pem"), WithRequiredAudience("other"))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = v.VerifyClient(t)
+			Expect(err).To(MatchError(jwt.ErrTokenInvalidAudience))
+
+			v, err = NewVerifier(WithTrustedKeyFiles("testdata/rsa/signer-public.pem"), WithRequiredIssuer("other"))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = v.VerifyClient(t)
+			Expect(err).To(MatchError(jwt.ErrTokenInvalidIssuer))
+
+			v, err = NewVerifier(WithTrustedKeyFiles("testdata/rsa/signer-public.pem"), WithRequiredIssuer("ginkgo"), WithRequiredAudience("choria"))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = v.VerifyClient(t)
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Describe("VerifyServer", func() {
+		It("Should verify server tokens", func() {
+			pk, _ := loadEd25519Seed("testdata/ed25519/other.seed")
+			server, err := NewServerClaims("ginkgo.example.net", []string{"choria"}, "", nil, nil, pk, "", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			t, err := SignTokenWithKeyFile(server, "testdata/ed25519/signer.seed")
+			Expect(err).ToNot(HaveOccurred())
+
+			v, err := NewVerifier(WithTrustedKeyFiles("testdata/ed25519/signer.public"))
+			Expect(err).ToNot(HaveOccurred())
+
+			parsed, err := v.VerifyServer(t)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed.ChoriaIdentity).To(Equal("ginkgo.example.net"))
+
+			t, err = SignTokenWithKeyFile(client, "testdata/ed25519/signer.seed")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = v.VerifyServer(t)
+			Expect(err).To(MatchError(ErrNotAServerToken))
+		})
+	})
+
+	Describe("Verify", func() {
+		It("Should perform the checks registered for the claims", func() {
+			registerTestAgentPurpose()
+
+			std, err := newStandardClaims("", testAgentPurpose, time.Hour, false)
+			Expect(err).ToNot(HaveOccurred())
+			t, err := SignTokenWithKeyFile(&testAgentClaims{StandardClaims: *std}, "testdata/ed25519/signer.seed")
+			Expect(err).ToNot(HaveOccurred())
+
+			v, err := NewVerifier(WithTrustedKeyFiles("testdata/ed25519/signer.public"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(v.Verify(t, &testAgentClaims{})).To(MatchError("agent is required"))
+
+			t, err = SignTokenWithKeyFile(&testAgentClaims{Agent: "rpcutil", StandardClaims: *std}, "testdata/ed25519/signer.seed")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(v.Verify(t, &testAgentClaims{})).To(Succeed())
+		})
+
+		It("Should check tokens against revocation lists set using parse options", func() {
+			list, err := NewRevocationListClaims("", time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(list.RevokeToken(client.ID)).To(Succeed())
+
+			t, err := SignTokenWithKeyFile(client, "testdata/ed25519/signer.seed")
+			Expect(err).ToNot(HaveOccurred())
+
+			v, err := NewVerifier(WithTrustedKeyFiles("testdata/ed25519/signer.public"), WithParseOptions(WithRevocations(list)))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = v.VerifyClient(t)
+			Expect(errors.Is(err, ErrRevoked)).To(BeTrue())
+		})
+	})
+})